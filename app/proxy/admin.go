@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+/////////////////////////////// Administration ///////////////////////////////
+
+// handleAdmin executes the administrative action named by the request path after the configured admin prefix
+func handleAdmin(config *Configuration, w http.ResponseWriter, req *http.Request) {
+	action := strings.Trim(strings.TrimPrefix(req.URL.Path, config.Admin), "/")
+
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		w.Write([]byte("Admin actions must be called via POST\n"))
+		return
+	}
+
+	var err error
+	switch action {
+
+	case "har/rotate":
+		if config.HAR == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("HAR export is not enabled\n"))
+			return
+		}
+		err = config.HAR.rotate()
+
+	case "cache/purge":
+		name := req.URL.Query().Get("proxy")
+		for path, proxy := range config.Proxies {
+			if proxy.Cache != nil && (name == "" || name == path) && err == nil {
+				err = proxy.Cache.purge()
+			}
+		}
+
+	case "faults/enable", "faults/disable":
+		found := false
+		name := req.URL.Query().Get("route")
+		for _, options := range config.routeOptions() {
+			if options.Faults != nil && (name == "" || name == options.path) {
+				options.Faults.enable(action == "faults/enable")
+				found = true
+			}
+		}
+		if !found {
+			w.WriteHeader(404)
+			w.Write([]byte("No fault injection configured\n"))
+			return
+		}
+
+	default:
+		w.WriteHeader(404)
+		w.Write([]byte("Unknown admin action: " + action + "\n"))
+		return
+	}
+
+	if err != nil {
+		logError("Admin action \"%s\": %s\n", action, err.Error())
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error() + "\n"))
+		return
+	}
+
+	logStd("Admin action \"%s\" executed\n", action)
+	w.Write([]byte("OK\n"))
+}
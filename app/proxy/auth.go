@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// AuthTypeBasic sends user and password as basic authentication
+	AuthTypeBasic = "basic"
+	// AuthTypeBearer sends a fixed bearer token
+	AuthTypeBearer = "bearer"
+	// AuthTypeAPIKey sends a fixed key in a header or query parameter
+	AuthTypeAPIKey = "api-key"
+	// AuthTypeOAuth2 fetches bearer tokens using the OAuth2 client credentials grant
+	AuthTypeOAuth2 = "oauth2"
+	// AuthTypeDigest answers HTTP digest authentication challenges
+	AuthTypeDigest = "digest"
+	// AuthTypeHelper runs an external credential helper program to obtain headers and cookies
+	AuthTypeHelper = "helper"
+)
+
+// Secret is a configuration value that can also be read from an environment variable ("env:NAME") or a file
+// ("file:path")
+type Secret string
+
+// UpstreamAuth describes how goproxy authenticates against the upstreams of a proxy entry
+type UpstreamAuth struct {
+	Type         string            `json:"type"`
+	User         string            `json:"user"`
+	Password     Secret            `json:"password"`
+	Credentials  Secret            `json:"credentials"`
+	Token        Secret            `json:"token"`
+	Name         string            `json:"name"`
+	In           string            `json:"in"`
+	Value        Secret            `json:"value"`
+	TokenURL     string            `json:"token-url"`
+	ClientID     string            `json:"client-id"`
+	ClientSecret Secret            `json:"client-secret"`
+	Scopes       []string          `json:"scopes"`
+	Parameters   map[string]string `json:"parameters"`
+	Executable   string            `json:"executable"`
+	Arguments    []string          `json:"arguments"`
+	Log          bool              `json:"log"`
+
+	password     string
+	token        string
+	value        string
+	clientSecret string
+
+	mutex        sync.Mutex
+	tokenExpires time.Time
+	challenge    map[string]string
+	nonceCount   int
+	helper       *Plugin
+	config       *Configuration
+	helperHeader http.Header
+}
+
+// authTransport adds the authentication to all requests sent to the upstreams
+type authTransport struct {
+	base  http.RoundTripper
+	auth  *UpstreamAuth
+	hosts map[string]bool
+}
+
+// UnmarshalJSON implements json.Unmarshaler, a string is treated as basic authentication with either "user:password"
+// or the already base64 encoded credentials
+func (auth *UpstreamAuth) UnmarshalJSON(data []byte) error {
+	var credentials string
+	if json.Unmarshal(data, &credentials) == nil {
+		auth.Type = AuthTypeBasic
+		if strings.Index(credentials, ":") > -1 {
+			parts := strings.SplitN(credentials, ":", 2)
+			auth.User = parts[0]
+			auth.Password = Secret(parts[1])
+		} else {
+			auth.Credentials = Secret(credentials)
+		}
+		return nil
+	}
+
+	type plainAuth UpstreamAuth
+	return json.Unmarshal(data, (*plainAuth)(auth))
+}
+
+// resolve returns the value of the secret
+func (secret Secret) resolve() (string, error) {
+	value := string(secret)
+
+	if strings.HasPrefix(value, "env:") {
+		name := strings.TrimPrefix(value, "env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable \"%s\" is not set", name)
+		}
+		return value, nil
+	}
+
+	if strings.HasPrefix(value, "file:") {
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return value, nil
+}
+
+/////////////////////////////// Upstream Authentication ///////////////////////////////
+
+func (auth *UpstreamAuth) init(config *Configuration, proxy *Proxy) error {
+	if auth == nil {
+		return nil
+	}
+
+	var err error
+	resolve := func(secret Secret) string {
+		value, e := secret.resolve()
+		if e != nil && err == nil {
+			err = e
+		}
+		return value
+	}
+
+	auth.password = resolve(auth.Password)
+	auth.token = resolve(auth.Token)
+	auth.value = resolve(auth.Value)
+	auth.clientSecret = resolve(auth.ClientSecret)
+	if err != nil {
+		return err
+	}
+
+	switch auth.Type {
+	case AuthTypeBasic:
+		if auth.Credentials != "" {
+			auth.token = resolve(auth.Credentials)
+		} else {
+			auth.token = base64.StdEncoding.EncodeToString([]byte(auth.User + ":" + auth.password))
+		}
+	case AuthTypeBearer, AuthTypeDigest:
+	case AuthTypeAPIKey:
+		if auth.Name == "" {
+			return errors.New("api-key authentication needs a name")
+		}
+		if auth.In != "" && auth.In != "header" && auth.In != "query" {
+			return fmt.Errorf("api-key authentication can be sent in \"header\" or \"query\", not \"%s\"", auth.In)
+		}
+	case AuthTypeOAuth2:
+		if auth.TokenURL == "" {
+			return errors.New("oauth2 authentication needs a token-url")
+		}
+	case AuthTypeHelper:
+		if auth.Executable == "" {
+			return errors.New("helper authentication needs an executable")
+		}
+		auth.helper = &Plugin{
+			Executable: auth.Executable,
+			Arguments:  auth.Arguments,
+			Log:        auth.Log,
+			URLFrom:    proxy.URLFrom,
+		}
+		auth.helper.timeouts = proxy.timeouts
+		auth.config = config
+	default:
+		return fmt.Errorf("unknown authentication type \"%s\"", auth.Type)
+	}
+
+	return err
+}
+
+func (transport *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Never send credentials to other hosts, for example after redirects
+	if !transport.hosts[req.URL.Host] {
+		return transport.base.RoundTrip(req)
+	}
+
+	auth := transport.auth
+	authReq, err := auth.apply(req, transport.base)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := transport.base.RoundTrip(authReq)
+	if err != nil || resp.StatusCode != 401 {
+		return resp, err
+	}
+
+	// Answer authentication challenges and refresh expired credentials if the request can be sent again
+	if auth.Type != AuthTypeDigest && auth.Type != AuthTypeOAuth2 && auth.Type != AuthTypeHelper {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, err
+	}
+	if auth.Type == AuthTypeDigest && !auth.setChallenge(resp.Header.Get("WWW-Authenticate")) {
+		return resp, err
+	}
+	if auth.Type == AuthTypeOAuth2 || auth.Type == AuthTypeHelper {
+		auth.mutex.Lock()
+		auth.tokenExpires = time.Time{}
+		auth.helperHeader = nil
+		auth.mutex.Unlock()
+	}
+
+	resp.Body.Close()
+
+	authReq, err = auth.apply(req, transport.base)
+	if err != nil {
+		return nil, err
+	}
+	if req.GetBody != nil {
+		authReq.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return transport.base.RoundTrip(authReq)
+}
+
+// apply returns a copy of the request with the authentication added
+func (auth *UpstreamAuth) apply(req *http.Request, base http.RoundTripper) (*http.Request, error) {
+	authReq := req.Clone(req.Context())
+
+	switch auth.Type {
+	case AuthTypeBasic:
+		authReq.Header.Set("Authorization", "Basic "+auth.token)
+
+	case AuthTypeBearer:
+		authReq.Header.Set("Authorization", "Bearer "+auth.token)
+
+	case AuthTypeAPIKey:
+		if auth.In == "query" {
+			query := authReq.URL.Query()
+			query.Set(auth.Name, auth.value)
+			authReq.URL.RawQuery = query.Encode()
+		} else {
+			authReq.Header.Set(auth.Name, auth.value)
+		}
+
+	case AuthTypeOAuth2:
+		token, err := auth.oauth2Token(base)
+		if err != nil {
+			return nil, err
+		}
+		authReq.Header.Set("Authorization", "Bearer "+token)
+
+	case AuthTypeDigest:
+		if authorization := auth.digestAuthorization(authReq); authorization != "" {
+			authReq.Header.Set("Authorization", authorization)
+		}
+
+	case AuthTypeHelper:
+		header, err := auth.helperCredentials(req)
+		if err != nil {
+			return nil, err
+		}
+		for name, values := range header {
+			if name == "Cookie" && authReq.Header.Get("Cookie") != "" {
+				// Keep the cookies sent by the browser
+				authReq.Header.Set("Cookie", authReq.Header.Get("Cookie")+"; "+strings.Join(values, "; "))
+				continue
+			}
+			authReq.Header[name] = values
+		}
+	}
+
+	return authReq, nil
+}
+
+/////////////////////////////// OAuth2 ///////////////////////////////
+
+// oauth2Token returns the current access token, a new one is fetched via client credentials grant if it has expired
+func (auth *UpstreamAuth) oauth2Token(base http.RoundTripper) (string, error) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	if auth.token != "" && time.Now().Before(auth.tokenExpires) {
+		return auth.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	if len(auth.Scopes) > 0 {
+		form.Set("scope", strings.Join(auth.Scopes, " "))
+	}
+	for key, value := range auth.Parameters {
+		form.Set(key, value)
+	}
+
+	tokenReq, err := http.NewRequest("POST", auth.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	tokenReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	tokenReq.Header.Set("Accept", "application/json")
+	tokenReq.SetBasicAuth(url.QueryEscape(auth.ClientID), url.QueryEscape(auth.clientSecret))
+
+	client := &http.Client{Transport: base, Timeout: 30 * time.Second}
+	resp, err := client.Do(tokenReq)
+	if err != nil {
+		return "", fmt.Errorf("OAuth2 token request failed: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("OAuth2 token request failed: %s", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("OAuth2 token request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}{}
+	err = json.Unmarshal(body, &token)
+	if err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("OAuth2 token response contains no access token")
+	}
+
+	expiresIn := time.Duration(token.ExpiresIn) * time.Second
+	if expiresIn <= 0 {
+		expiresIn = time.Hour
+	}
+
+	// Refresh the token shortly before it expires
+	auth.token = token.AccessToken
+	auth.tokenExpires = time.Now().Add(expiresIn * 9 / 10)
+	logDebug("Fetched OAuth2 token from %s, valid for %s\n", auth.TokenURL, expiresIn)
+
+	return auth.token, nil
+}
+
+/////////////////////////////// Credential Helper ///////////////////////////////
+
+// helperCredentials returns the headers reported by the credential helper, the helper is run again once they expire
+func (auth *UpstreamAuth) helperCredentials(req *http.Request) (http.Header, error) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	if auth.helperHeader != nil && (auth.tokenExpires.IsZero() || time.Now().Before(auth.tokenExpires)) {
+		return auth.helperHeader, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(auth.helper.timeouts.Plugin))
+	defer cancel()
+
+	cmd := pluginCommand(ctx, auth.config, auth.helper, req)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("GOPROXY_ROUTE=%s", auth.helper.URLFrom),
+		fmt.Sprintf("GOPROXY_UPSTREAM=%s://%s", req.URL.Scheme, req.URL.Host),
+		fmt.Sprintf("GOPROXY_URL=%s", req.URL.String()),
+	)
+
+	errorBuffer := bytes.Buffer{}
+	cmd.Stderr = &errorBuffer
+	output, err := cmd.Output()
+
+	if auth.Log && errorBuffer.Len() > 0 {
+		fmt.Fprintf(os.Stderr, "Credential Helper Error Output: \n |%s\n\n", strings.ReplaceAll(errorBuffer.String(), "\n", "\n |"))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("credential helper \"%s\" failed: %s", auth.Executable, err.Error())
+	}
+
+	// The helper output consists of header lines, the expiry is given as "Expires-In" (seconds) or "Expires" (date)
+	_, header, _ := parseCGIOutput(output, 200)
+
+	auth.tokenExpires = time.Time{}
+	if seconds, err := strconv.Atoi(header.Get("Expires-In")); err == nil {
+		auth.tokenExpires = time.Now().Add(time.Duration(seconds) * time.Second)
+	} else if expires, err := http.ParseTime(header.Get("Expires")); err == nil {
+		auth.tokenExpires = expires
+	}
+	header.Del("Expires-In")
+	header.Del("Expires")
+
+	auth.helperHeader = header
+	logDebug("Credential helper \"%s\" returned %d headers\n", auth.Executable, len(header))
+
+	return header, nil
+}
+
+/////////////////////////////// HTTP Digest ///////////////////////////////
+
+// setChallenge stores the parameters of a digest challenge, it returns false if the header contains none
+func (auth *UpstreamAuth) setChallenge(header string) bool {
+	if !strings.HasPrefix(strings.ToLower(header), "digest ") {
+		return false
+	}
+
+	challenge := map[string]string{}
+	for _, part := range splitDigestParameters(header[len("digest "):]) {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) == 2 {
+			challenge[strings.ToLower(strings.TrimSpace(pair[0]))] = strings.Trim(strings.TrimSpace(pair[1]), "\"")
+		}
+	}
+	if challenge["nonce"] == "" {
+		return false
+	}
+
+	auth.mutex.Lock()
+	auth.challenge = challenge
+	auth.nonceCount = 0
+	auth.mutex.Unlock()
+	return true
+}
+
+// digestAuthorization computes the authorization header for the last received challenge, see RFC 7616
+func (auth *UpstreamAuth) digestAuthorization(req *http.Request) string {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+
+	challenge := auth.challenge
+	if challenge == nil {
+		return ""
+	}
+	auth.nonceCount++
+
+	var newHash func() hash.Hash
+	algorithm := strings.ToUpper(challenge["algorithm"])
+	switch strings.TrimSuffix(algorithm, "-SESS") {
+	case "SHA-256":
+		newHash = sha256.New
+	default:
+		newHash = md5.New
+	}
+	digest := func(parts ...string) string {
+		h := newHash()
+		h.Write([]byte(strings.Join(parts, ":")))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	cnonceBytes := make([]byte, 8)
+	rand.Read(cnonceBytes)
+	cnonce := hex.EncodeToString(cnonceBytes)
+	nc := fmt.Sprintf("%08x", auth.nonceCount)
+	uri := req.URL.RequestURI()
+
+	ha1 := digest(auth.User, challenge["realm"], auth.password)
+	if strings.HasSuffix(algorithm, "-SESS") {
+		ha1 = digest(ha1, challenge["nonce"], cnonce)
+	}
+	ha2 := digest(req.Method, uri)
+
+	qop := ""
+	for _, option := range strings.Split(challenge["qop"], ",") {
+		if strings.TrimSpace(option) == "auth" {
+			qop = "auth"
+		}
+	}
+
+	var response string
+	if qop != "" {
+		response = digest(ha1, challenge["nonce"], nc, cnonce, qop, ha2)
+	} else {
+		response = digest(ha1, challenge["nonce"], ha2)
+	}
+
+	authorization := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s", response="%s"`,
+		auth.User, challenge["realm"], challenge["nonce"], uri, response)
+	if algorithm != "" {
+		authorization += fmt.Sprintf(", algorithm=%s", challenge["algorithm"])
+	}
+	if qop != "" {
+		authorization += fmt.Sprintf(`, qop=%s, nc=%s, cnonce="%s"`, qop, nc, cnonce)
+	}
+	if challenge["opaque"] != "" {
+		authorization += fmt.Sprintf(`, opaque="%s"`, challenge["opaque"])
+	}
+
+	return authorization
+}
+
+// splitDigestParameters splits the comma separated challenge parameters, commas inside quotes are ignored
+func splitDigestParameters(parameters string) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+	for i, c := range parameters {
+		switch c {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = append(parts, parameters[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, parameters[start:])
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSetChallenge(t *testing.T) {
+	tests := []struct {
+		header    string
+		valid     bool
+		challenge map[string]string
+	}{
+		{`Basic realm="x"`, false, nil},
+		{`Digest realm="x"`, false, nil},
+		{"", false, nil},
+		{`Digest realm="test", nonce="abc", qop="auth,auth-int"`, true,
+			map[string]string{"realm": "test", "nonce": "abc", "qop": "auth,auth-int"}},
+		{`digest Realm="a, b", NONCE=n1, algorithm=SHA-256, opaque="o"`, true,
+			map[string]string{"realm": "a, b", "nonce": "n1", "algorithm": "SHA-256", "opaque": "o"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			auth := &UpstreamAuth{}
+			if valid := auth.setChallenge(test.header); valid != test.valid {
+				t.Fatalf("setChallenge = %t, want %t", valid, test.valid)
+			}
+			if !test.valid {
+				return
+			}
+			if fmt.Sprint(auth.challenge) != fmt.Sprint(test.challenge) {
+				t.Errorf("challenge = %v, want %v", auth.challenge, test.challenge)
+			}
+		})
+	}
+}
+
+func TestDigestAuthorization(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge string
+		newHash   func() hash.Hash
+		qop       bool
+		session   bool
+	}{
+		{"rfc 2069", `Digest realm="testrealm@host.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093"`,
+			md5.New, false, false},
+		{"md5 auth", `Digest realm="testrealm@host.com", qop="auth,auth-int", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`,
+			md5.New, true, false},
+		{"md5-sess", `Digest realm="r", nonce="n", qop="auth", algorithm=MD5-sess`, md5.New, true, true},
+		{"sha-256", `Digest realm="http-auth@example.org", qop="auth, auth-int", algorithm=SHA-256, nonce="7ypf/xlj9XXwfDPEoM4URrv/xwf94BcCAzFZH4GiTo0v"`,
+			sha256.New, true, false},
+		{"auth-int only", `Digest realm="r", nonce="n", qop="auth-int"`, md5.New, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			auth := &UpstreamAuth{Type: AuthTypeDigest, User: "Mufasa", password: "Circle Of Life"}
+			if !auth.setChallenge(test.challenge) {
+				t.Fatal("challenge not accepted")
+			}
+			req := httptest.NewRequest("GET", "http://host.com/dir/index.html?a=1", nil)
+
+			for count := 1; count <= 2; count++ {
+				parameters := parseTestDigest(t, auth.digestAuthorization(req))
+				challenge := auth.challenge
+
+				if parameters["username"] != "Mufasa" || parameters["uri"] != "/dir/index.html?a=1" ||
+					parameters["nonce"] != challenge["nonce"] || parameters["realm"] != challenge["realm"] ||
+					parameters["opaque"] != challenge["opaque"] {
+					t.Errorf("unexpected parameters %v", parameters)
+				}
+
+				digest := func(parts ...string) string {
+					h := test.newHash()
+					h.Write([]byte(strings.Join(parts, ":")))
+					return hex.EncodeToString(h.Sum(nil))
+				}
+				ha1 := digest("Mufasa", challenge["realm"], "Circle Of Life")
+				if test.session {
+					ha1 = digest(ha1, challenge["nonce"], parameters["cnonce"])
+				}
+				ha2 := digest("GET", "/dir/index.html?a=1")
+
+				var expected string
+				if test.qop {
+					if nc := fmt.Sprintf("%08x", count); parameters["nc"] != nc {
+						t.Errorf("nc = %s, want %s", parameters["nc"], nc)
+					}
+					if parameters["qop"] != "auth" || parameters["cnonce"] == "" {
+						t.Errorf("qop or cnonce missing in %v", parameters)
+					}
+					expected = digest(ha1, challenge["nonce"], parameters["nc"], parameters["cnonce"], "auth", ha2)
+				} else {
+					if parameters["qop"] != "" || parameters["nc"] != "" {
+						t.Errorf("unexpected qop in %v", parameters)
+					}
+					expected = digest(ha1, challenge["nonce"], ha2)
+				}
+				if parameters["response"] != expected {
+					t.Errorf("response = %s, want %s", parameters["response"], expected)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestAuthorizationKnownResponse(t *testing.T) {
+	// Example of RFC 2069, answered without qop
+	auth := &UpstreamAuth{Type: AuthTypeDigest, User: "Mufasa", password: "CircleOfLife"}
+	auth.setChallenge(`Digest realm="testrealm@host.com", nonce="dcd98b7102dd2f0e8b11d0f600bfb0c093", opaque="5ccc069c403ebaf9f0171e9517f40e41"`)
+	req := httptest.NewRequest("GET", "http://host.com/dir/index.html", nil)
+
+	parameters := parseTestDigest(t, auth.digestAuthorization(req))
+	if parameters["response"] != "1949323746fe6a43ef61f9606e7febea" {
+		t.Errorf("response = %s", parameters["response"])
+	}
+
+	if (&UpstreamAuth{}).digestAuthorization(req) != "" {
+		t.Error("no authorization expected without a challenge")
+	}
+}
+
+func TestDigestTransport(t *testing.T) {
+	var mutex sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		requests++
+		mutex.Unlock()
+
+		body, _ := ioutil.ReadAll(req.Body)
+		authorization := req.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Digest ") {
+			w.Header().Set("WWW-Authenticate", `Digest realm="test", nonce="n1", qop="auth"`)
+			w.WriteHeader(401)
+			return
+		}
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse(server.URL)
+	auth := &UpstreamAuth{Type: AuthTypeDigest, User: "user", Password: "secret"}
+	if err := auth.init(&Configuration{}, &Proxy{}); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &authTransport{
+		base:  http.DefaultTransport,
+		auth:  auth,
+		hosts: map[string]bool{target.Host: true},
+	}}
+
+	tests := []struct {
+		body     string
+		requests int
+	}{
+		// The first request is answered with the challenge and sent again
+		{"first", 2},
+		// Later requests answer the stored challenge directly
+		{"second", 1},
+	}
+	for _, test := range tests {
+		mutex.Lock()
+		requests = 0
+		mutex.Unlock()
+
+		resp, err := client.Post(server.URL+"/path", "text/plain", strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 || string(body) != test.body {
+			t.Errorf("%s: status %d, body %q", test.body, resp.StatusCode, body)
+		}
+		if requests != test.requests {
+			t.Errorf("%s: %d requests, want %d", test.body, requests, test.requests)
+		}
+	}
+}
+
+func TestOAuth2TokenRefresh(t *testing.T) {
+	var mutex sync.Mutex
+	issued := 0
+	valid := ""
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		user, password, _ := req.BasicAuth()
+		req.ParseForm()
+		if user != "client" || password != "secret" || req.Form.Get("grant_type") != "client_credentials" ||
+			req.Form.Get("scope") != "read write" || req.Form.Get("audience") != "api" {
+			w.WriteHeader(400)
+			return
+		}
+
+		mutex.Lock()
+		issued++
+		valid = fmt.Sprintf("token-%d", issued)
+		fmt.Fprintf(w, `{"access_token": "%s", "expires_in": 3600}`, valid)
+		mutex.Unlock()
+	}))
+	defer tokenServer.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if req.Header.Get("Authorization") != "Bearer "+valid {
+			w.WriteHeader(401)
+			return
+		}
+		w.Write([]byte(valid))
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse(server.URL)
+	auth := &UpstreamAuth{
+		Type:         AuthTypeOAuth2,
+		TokenURL:     tokenServer.URL,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Scopes:       []string{"read", "write"},
+		Parameters:   map[string]string{"audience": "api"},
+	}
+	if err := auth.init(&Configuration{}, &Proxy{}); err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &authTransport{
+		base:  http.DefaultTransport,
+		auth:  auth,
+		hosts: map[string]bool{target.Host: true},
+	}}
+
+	tests := []struct {
+		name   string
+		before func()
+		token  string
+		issued int
+	}{
+		{"fetches a token", func() {}, "token-1", 1},
+		{"reuses the token", func() {}, "token-1", 1},
+		{"refreshes an expired token", func() { auth.tokenExpires = time.Now().Add(-time.Second) }, "token-2", 2},
+		{"refreshes a rejected token", func() {
+			mutex.Lock()
+			valid = "revoked"
+			mutex.Unlock()
+		}, "token-3", 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.before()
+
+			resp, err := client.Get(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != 200 || string(body) != test.token {
+				t.Errorf("status %d, body %q, want %q", resp.StatusCode, body, test.token)
+			}
+			if issued != test.issued {
+				t.Errorf("%d tokens issued, want %d", issued, test.issued)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		response string
+	}{
+		{"error status", 401, `{"error": "invalid_client"}`},
+		{"no token", 200, `{"token_type": "bearer"}`},
+		{"invalid json", 200, `token`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.response))
+			}))
+			defer tokenServer.Close()
+
+			auth := &UpstreamAuth{Type: AuthTypeOAuth2, TokenURL: tokenServer.URL}
+			if token, err := auth.oauth2Token(http.DefaultTransport); err == nil {
+				t.Errorf("expected an error, got token %q", token)
+			}
+		})
+	}
+}
+
+// parseTestDigest returns the parameters of a digest authorization header
+func parseTestDigest(t *testing.T, authorization string) map[string]string {
+	if !strings.HasPrefix(authorization, "Digest ") {
+		t.Fatalf("invalid authorization %q", authorization)
+	}
+	parameters := map[string]string{}
+	for _, part := range splitDigestParameters(authorization[len("Digest "):]) {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) == 2 {
+			parameters[strings.TrimSpace(pair[0])] = strings.Trim(strings.TrimSpace(pair[1]), "\"")
+		}
+	}
+	return parameters
+}
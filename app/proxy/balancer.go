@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream describes one of the target systems of a proxy entry
+type Upstream struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight"`
+
+	target        *url.URL
+	address       string
+	socket        string
+	id            string
+	active        int64
+	mutex         sync.Mutex
+	unhealthy     bool
+	fails         int
+	ejectedUntil  time.Time
+	currentWeight int
+}
+
+// HealthCheck describes the active health checks for the upstreams of a proxy entry
+type HealthCheck struct {
+	Path     string   `json:"path"`
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler, upstreams can be given as URL string or as object
+func (upstream *Upstream) UnmarshalJSON(data []byte) error {
+	var urlString string
+	if json.Unmarshal(data, &urlString) == nil {
+		upstream.URL = urlString
+		return nil
+	}
+
+	type plainUpstream Upstream
+	return json.Unmarshal(data, (*plainUpstream)(upstream))
+}
+
+/////////////////////////////// Upstreams ///////////////////////////////
+
+func (proxy *Proxy) initUpstreams() error {
+	if proxy.URLTo != "" {
+		proxy.Upstreams = append([]*Upstream{{URL: proxy.URLTo}}, proxy.Upstreams...)
+	}
+	if len(proxy.Upstreams) == 0 {
+		return errors.New("no target url configured")
+	}
+
+	switch proxy.Balance {
+	case "":
+		proxy.Balance = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConnections, BalanceRandom, BalanceWeighted:
+	default:
+		return fmt.Errorf("unknown balance strategy \"%s\"", proxy.Balance)
+	}
+
+	for _, upstream := range proxy.Upstreams {
+		err := upstream.init()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The first upstream is used for display and logging purposes
+	proxy.URLTo = proxy.Upstreams[0].URL
+
+	return nil
+}
+
+// init resolves the URL of the upstream, unix socket URLs are replaced by a host name standing in for the socket
+func (upstream *Upstream) init() error {
+	if upstream.Weight <= 0 {
+		upstream.Weight = 1
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(upstream.URL))
+	upstream.id = fmt.Sprintf("%08x", hash.Sum32())
+
+	upstream.address = upstream.URL
+	if strings.HasPrefix(upstream.URL, UpstreamSocketPrefix) {
+		var base string
+		var err error
+		upstream.socket, base, err = parseSocketURL(upstream.URL)
+		if err != nil {
+			return err
+		}
+		// Requests are addressed to a host name standing in for the socket, see createDialer
+		upstream.address = "http://" + upstream.id + socketHostSuffix + base
+	}
+
+	target, err := url.Parse(upstream.address)
+	if err != nil {
+		return err
+	}
+	upstream.target = target
+
+	return nil
+}
+
+// available returns whether the upstream may currently receive requests
+func (upstream *Upstream) available() bool {
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+	return !upstream.unhealthy && time.Now().After(upstream.ejectedUntil)
+}
+
+// acquire marks the start of a request to the upstream, the returned function must be called when it is done
+func (upstream *Upstream) acquire() func() {
+	atomic.AddInt64(&upstream.active, 1)
+	return func() {
+		atomic.AddInt64(&upstream.active, -1)
+	}
+}
+
+// releasingBody ends the request to an upstream when the response body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (body *releasingBody) Close() error {
+	body.once.Do(body.release)
+	return body.ReadCloser.Close()
+}
+
+// reportSuccess resets the passive failure counter of the upstream
+func (upstream *Upstream) reportSuccess() {
+	upstream.mutex.Lock()
+	upstream.fails = 0
+	upstream.mutex.Unlock()
+}
+
+// reportFailure counts a failed request and ejects the upstream after too many consecutive failures
+func (upstream *Upstream) reportFailure(proxy *Proxy) {
+	if proxy.MaxFails <= 0 {
+		return
+	}
+
+	upstream.mutex.Lock()
+	defer upstream.mutex.Unlock()
+
+	upstream.fails++
+	if upstream.fails >= proxy.MaxFails {
+		upstream.fails = 0
+		upstream.ejectedUntil = time.Now().Add(proxy.FailTimeout.Or(30 * time.Second))
+		logError("Upstream %s ejected after %d consecutive failures\n", upstream.URL, proxy.MaxFails)
+	}
+}
+
+/////////////////////////////// Selection ///////////////////////////////
+
+// selectUpstream chooses the upstream for the given request according to the configured strategy
+func (proxy *Proxy) selectUpstream(req *http.Request) *Upstream {
+	if upstream := hookUpstream(req); upstream != nil {
+		return upstream
+	}
+	if len(proxy.Upstreams) == 1 {
+		return proxy.Upstreams[0]
+	}
+
+	candidates := make([]*Upstream, 0, len(proxy.Upstreams))
+	for _, upstream := range proxy.Upstreams {
+		if upstream.available() {
+			candidates = append(candidates, upstream)
+		}
+	}
+	if len(candidates) == 0 {
+		// Better try an unavailable upstream than fail without trying
+		candidates = proxy.Upstreams
+	}
+
+	if proxy.StickyCookie != "" {
+		cookie, err := req.Cookie(proxy.StickyCookie)
+		if err == nil {
+			for _, upstream := range candidates {
+				if upstream.id == cookie.Value {
+					return upstream
+				}
+			}
+		}
+	}
+
+	switch proxy.Balance {
+	case BalanceLeastConnections:
+		selected := candidates[0]
+		for _, upstream := range candidates[1:] {
+			if atomic.LoadInt64(&upstream.active) < atomic.LoadInt64(&selected.active) {
+				selected = upstream
+			}
+		}
+		return selected
+
+	case BalanceRandom:
+		return candidates[rand.Intn(len(candidates))]
+
+	case BalanceWeighted:
+		// Smooth weighted round-robin as used by nginx
+		proxy.balanceMutex.Lock()
+		defer proxy.balanceMutex.Unlock()
+
+		var selected *Upstream
+		total := 0
+		for _, upstream := range candidates {
+			upstream.currentWeight += upstream.Weight
+			total += upstream.Weight
+			if selected == nil || upstream.currentWeight > selected.currentWeight {
+				selected = upstream
+			}
+		}
+		selected.currentWeight -= total
+		return selected
+
+	default:
+		next := atomic.AddUint64(&proxy.balanceCounter, 1)
+		return candidates[(next-1)%uint64(len(candidates))]
+	}
+}
+
+// setStickyCookie binds the client to the upstream that answered its request
+func (proxy *Proxy) setStickyCookie(w http.ResponseWriter, req *http.Request, upstream *Upstream) {
+	// Upstreams selected by hooks are not part of the proxy, the client stays bound to its previous upstream
+	if proxy.StickyCookie == "" || hookUpstream(req) != nil {
+		return
+	}
+
+	cookie, err := req.Cookie(proxy.StickyCookie)
+	if err == nil && cookie.Value == upstream.id {
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     proxy.StickyCookie,
+		Value:    upstream.id,
+		Path:     proxy.URLFrom,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+/////////////////////////////// Health Checks ///////////////////////////////
+
+func (proxy *Proxy) runHealthChecks() {
+	interval := proxy.HealthCheck.Interval.Or(10 * time.Second)
+	client := &http.Client{
+		Timeout:   proxy.HealthCheck.Timeout.Or(5 * time.Second),
+		Transport: proxy.client.Transport,
+	}
+
+	for {
+		for _, upstream := range proxy.Upstreams {
+			checkUpstream(client, upstream, proxy.HealthCheck.Path)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func checkUpstream(client *http.Client, upstream *Upstream, path string) {
+	checkURL := strings.TrimSuffix(upstream.address, "/") + "/" + strings.TrimPrefix(path, "/")
+
+	healthy := false
+	resp, err := client.Get(checkURL)
+	if err == nil {
+		resp.Body.Close()
+		healthy = resp.StatusCode < 400
+	}
+
+	upstream.mutex.Lock()
+	changed := upstream.unhealthy == healthy
+	upstream.unhealthy = !healthy
+	upstream.mutex.Unlock()
+
+	if changed && healthy {
+		logStd("Upstream %s is healthy again\n", upstream.URL)
+	} else if changed && err != nil {
+		logError("Upstream %s failed health check: %s\n", upstream.URL, err.Error())
+	} else if changed {
+		logError("Upstream %s failed health check: status %d\n", upstream.URL, resp.StatusCode)
+	}
+}
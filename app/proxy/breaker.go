@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The states of a circuit breaker
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// errCircuitOpen is returned instead of contacting the upstream while the circuit breaker is open
+var errCircuitOpen = errors.New("circuit breaker is open, upstream is considered unavailable")
+
+// CircuitBreaker stops sending requests to the upstreams of a proxy entry when too many of them fail
+type CircuitBreaker struct {
+	FailureRatio     float64       `json:"failure-ratio"`
+	MinRequests      int           `json:"min-requests"`
+	Window           Duration      `json:"window"`
+	OpenDuration     Duration      `json:"open-duration"`
+	HalfOpenRequests int           `json:"half-open-requests"`
+	Fallback         *MockResponse `json:"fallback"`
+
+	name        string
+	mutex       sync.Mutex
+	state       string
+	requests    int
+	failures    int
+	windowStart time.Time
+	openedAt    time.Time
+	probes      int
+	successes   int
+}
+
+/////////////////////////////// Circuit Breaker ///////////////////////////////
+
+func (breaker *CircuitBreaker) init(name string) {
+	if breaker == nil {
+		return
+	}
+	if breaker.FailureRatio <= 0 || breaker.FailureRatio > 1 {
+		breaker.FailureRatio = 0.5
+	}
+	if breaker.MinRequests <= 0 {
+		breaker.MinRequests = 10
+	}
+	if breaker.HalfOpenRequests <= 0 {
+		breaker.HalfOpenRequests = 1
+	}
+	breaker.name = name
+	breaker.state = circuitClosed
+	breaker.windowStart = time.Now()
+}
+
+// allow returns whether a request may be sent to the upstream
+func (breaker *CircuitBreaker) allow() bool {
+	if breaker == nil {
+		return true
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case circuitOpen:
+		if time.Since(breaker.openedAt) < breaker.OpenDuration.Or(30*time.Second) {
+			return false
+		}
+		breaker.setState(circuitHalfOpen)
+		breaker.probes = 1
+		return true
+
+	case circuitHalfOpen:
+		// Only as many probes as still have to succeed are in flight at the same time
+		if breaker.probes+breaker.successes >= breaker.HalfOpenRequests {
+			return false
+		}
+		breaker.probes++
+		return true
+
+	default:
+		return true
+	}
+}
+
+// record updates the breaker state with the result of a request
+func (breaker *CircuitBreaker) record(failed bool) {
+	if breaker == nil {
+		return
+	}
+
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+
+	switch breaker.state {
+	case circuitHalfOpen:
+		if failed {
+			breaker.open()
+		} else {
+			if breaker.probes > 0 {
+				breaker.probes--
+			}
+			breaker.successes++
+			if breaker.successes >= breaker.HalfOpenRequests {
+				breaker.reset()
+				breaker.setState(circuitClosed)
+			}
+		}
+
+	case circuitClosed:
+		if time.Since(breaker.windowStart) > breaker.Window.Or(60*time.Second) {
+			breaker.reset()
+		}
+		breaker.requests++
+		if failed {
+			breaker.failures++
+		}
+		if breaker.requests >= breaker.MinRequests &&
+			float64(breaker.failures)/float64(breaker.requests) >= breaker.FailureRatio {
+			breaker.open()
+		}
+	}
+}
+
+func (breaker *CircuitBreaker) open() {
+	breaker.openedAt = time.Now()
+	breaker.reset()
+	breaker.setState(circuitOpen)
+}
+
+func (breaker *CircuitBreaker) reset() {
+	breaker.requests = 0
+	breaker.failures = 0
+	breaker.probes = 0
+	breaker.successes = 0
+	breaker.windowStart = time.Now()
+}
+
+func (breaker *CircuitBreaker) setState(state string) {
+	if breaker.state == state {
+		return
+	}
+	breaker.state = state
+
+	if state == circuitOpen {
+		logError("Circuit breaker for \"%s\" is now %s\n", breaker.name, state)
+	} else {
+		logStd("Circuit breaker for \"%s\" is now %s\n", breaker.name, state)
+	}
+}
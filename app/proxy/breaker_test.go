@@ -0,0 +1,157 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// breakerStep is an action on a circuit breaker followed by the expected state
+type breakerStep struct {
+	action string // "allow", "deny", "success", "failure", "expire" or "window"
+	state  string
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	tests := []struct {
+		name    string
+		breaker *CircuitBreaker
+		steps   []breakerStep
+	}{
+		{
+			name:    "stays closed below min requests",
+			breaker: &CircuitBreaker{MinRequests: 3},
+			steps: []breakerStep{
+				{"failure", circuitClosed},
+				{"failure", circuitClosed},
+				{"allow", circuitClosed},
+			},
+		},
+		{
+			name:    "opens when the ratio is reached",
+			breaker: &CircuitBreaker{MinRequests: 4, FailureRatio: 0.5},
+			steps: []breakerStep{
+				{"success", circuitClosed},
+				{"failure", circuitClosed},
+				{"success", circuitClosed},
+				{"failure", circuitOpen},
+				{"deny", circuitOpen},
+			},
+		},
+		{
+			name:    "stays closed below the ratio",
+			breaker: &CircuitBreaker{MinRequests: 4, FailureRatio: 0.75},
+			steps: []breakerStep{
+				{"failure", circuitClosed},
+				{"failure", circuitClosed},
+				{"success", circuitClosed},
+				{"success", circuitClosed},
+				{"failure", circuitClosed},
+			},
+		},
+		{
+			name:    "window resets the counters",
+			breaker: &CircuitBreaker{MinRequests: 2, FailureRatio: 1},
+			steps: []breakerStep{
+				{"failure", circuitClosed},
+				{"window", circuitClosed},
+				{"success", circuitClosed},
+				{"failure", circuitClosed},
+			},
+		},
+		{
+			name:    "single probe closes after success",
+			breaker: &CircuitBreaker{MinRequests: 1},
+			steps: []breakerStep{
+				{"failure", circuitOpen},
+				{"deny", circuitOpen},
+				{"expire", circuitOpen},
+				{"allow", circuitHalfOpen},
+				{"deny", circuitHalfOpen},
+				{"success", circuitClosed},
+				{"allow", circuitClosed},
+			},
+		},
+		{
+			name:    "failed probe reopens",
+			breaker: &CircuitBreaker{MinRequests: 1, HalfOpenRequests: 2},
+			steps: []breakerStep{
+				{"failure", circuitOpen},
+				{"expire", circuitOpen},
+				{"allow", circuitHalfOpen},
+				{"allow", circuitHalfOpen},
+				{"deny", circuitHalfOpen},
+				{"failure", circuitOpen},
+				{"deny", circuitOpen},
+			},
+		},
+		{
+			name:    "half-open needs all probes to succeed",
+			breaker: &CircuitBreaker{MinRequests: 1, HalfOpenRequests: 3},
+			steps: []breakerStep{
+				{"failure", circuitOpen},
+				{"expire", circuitOpen},
+				{"allow", circuitHalfOpen},
+				{"allow", circuitHalfOpen},
+				{"success", circuitHalfOpen},
+				{"allow", circuitHalfOpen},
+				{"deny", circuitHalfOpen},
+				{"success", circuitHalfOpen},
+				{"deny", circuitHalfOpen},
+				{"success", circuitClosed},
+			},
+		},
+		{
+			name:    "closed after half-open starts counting anew",
+			breaker: &CircuitBreaker{MinRequests: 2, FailureRatio: 1},
+			steps: []breakerStep{
+				{"failure", circuitClosed},
+				{"failure", circuitOpen},
+				{"expire", circuitOpen},
+				{"allow", circuitHalfOpen},
+				{"success", circuitClosed},
+				{"failure", circuitClosed},
+				{"failure", circuitOpen},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			breaker := test.breaker
+			breaker.init(test.name)
+
+			for i, step := range test.steps {
+				switch step.action {
+				case "allow", "deny":
+					if allowed := breaker.allow(); allowed != (step.action == "allow") {
+						t.Fatalf("step %d: allow() = %t", i, allowed)
+					}
+				case "success", "failure":
+					breaker.record(step.action == "failure")
+				case "expire":
+					breaker.openedAt = time.Now().Add(-breaker.OpenDuration.Or(30*time.Second) - time.Second)
+				case "window":
+					breaker.windowStart = time.Now().Add(-breaker.Window.Or(60*time.Second) - time.Second)
+				}
+				if breaker.state != step.state {
+					t.Fatalf("step %d (%s): state = %s, want %s", i, step.action, breaker.state, step.state)
+				}
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerDefaults(t *testing.T) {
+	breaker := &CircuitBreaker{FailureRatio: 2}
+	breaker.init("defaults")
+	if breaker.FailureRatio != 0.5 || breaker.MinRequests != 10 || breaker.HalfOpenRequests != 1 {
+		t.Errorf("unexpected defaults %+v", breaker)
+	}
+
+	var disabled *CircuitBreaker
+	disabled.init("disabled")
+	disabled.record(true)
+	if !disabled.allow() {
+		t.Error("a missing breaker must allow all requests")
+	}
+}
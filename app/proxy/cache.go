@@ -0,0 +1,404 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache describes the response cache of a proxy entry
+type ResponseCache struct {
+	MaxSize      int64    `json:"max-size"`
+	Directory    string   `json:"directory"`
+	TTL          Duration `json:"ttl"`
+	StaleIfError Duration `json:"stale-if-error"`
+	Private      bool     `json:"private"`
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	size    int64
+	vary    map[string][]string
+}
+
+// cacheEntry is a cached response, it is also the content of the cache files on disk
+type cacheEntry struct {
+	Key     string      `json:"key"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+}
+
+// varyIndex is the content of the cache files storing the Vary header names of a URL
+type varyIndex struct {
+	Key  string   `json:"key"`
+	Vary []string `json:"vary"`
+}
+
+// varyIndexPrefix distinguishes the keys of the vary index files from the keys of cache entries
+const varyIndexPrefix = "vary\n"
+
+/////////////////////////////// Response Cache ///////////////////////////////
+
+func (cache *ResponseCache) init() error {
+	if cache == nil {
+		return nil
+	}
+	if cache.MaxSize <= 0 {
+		cache.MaxSize = 64 * 1024 * 1024
+	}
+	cache.entries = map[string]*list.Element{}
+	cache.lru = list.New()
+	cache.vary = map[string][]string{}
+
+	if cache.Directory != "" {
+		return os.MkdirAll(cache.Directory, 0755)
+	}
+	return nil
+}
+
+// key returns the cache key for the request, requests that cannot be cached return an empty key. The key contains
+// the request headers the last response for the URL varied on.
+func (cache *ResponseCache) key(proxy *Proxy, req *http.Request) string {
+	if cache == nil || req.Method != "GET" {
+		return ""
+	}
+	if !cache.Private && req.Header.Get("Authorization") != "" {
+		return ""
+	}
+
+	base := cache.baseKey(proxy, req)
+	cache.mutex.Lock()
+	vary, ok := cache.vary[base]
+	cache.mutex.Unlock()
+	if !ok {
+		vary = cache.loadVary(base)
+	}
+	return variantKey(base, vary, req)
+}
+
+// storeKey remembers the Vary header of the response and returns the key the response is stored with
+func (cache *ResponseCache) storeKey(proxy *Proxy, req *http.Request, resp *http.Response) string {
+	base := cache.baseKey(proxy, req)
+	vary := varyHeaders(resp.Header)
+	cache.mutex.Lock()
+	cache.vary[base] = vary
+	cache.mutex.Unlock()
+	cache.persistVary(base, vary)
+	return variantKey(base, vary, req)
+}
+
+// loadVary reads the Vary header names stored for the URL from disk, so entries stored before a restart are found
+func (cache *ResponseCache) loadVary(base string) []string {
+	if cache.Directory == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(cache.file(varyIndexPrefix + base))
+	if err != nil {
+		return nil
+	}
+	index := &varyIndex{}
+	err = json.Unmarshal(data, index)
+	if err != nil || index.Key != base {
+		return nil
+	}
+
+	cache.mutex.Lock()
+	cache.vary[base] = index.Vary
+	cache.mutex.Unlock()
+	return index.Vary
+}
+
+func (cache *ResponseCache) persistVary(base string, vary []string) {
+	if cache.Directory == "" {
+		return
+	}
+
+	data, err := json.Marshal(&varyIndex{Key: base, Vary: vary})
+	if err == nil {
+		err = ioutil.WriteFile(cache.file(varyIndexPrefix+base), data, 0644)
+	}
+	if err != nil {
+		logError("Could not store cache vary index: %s\n", err.Error())
+	}
+}
+
+func (cache *ResponseCache) baseKey(proxy *Proxy, req *http.Request) string {
+	return strings.Replace(req.URL.Path, proxy.URLFrom, "", 1) + "?" + req.URL.Query().Encode()
+}
+
+// variantKey adds the request headers the response depends on to the key. The body is stored in the encoding the
+// upstream chose, so Accept-Encoding is always part of the key. Cookie is part of the key as well, since responses
+// may depend on the session without saying so.
+func variantKey(base string, vary []string, req *http.Request) string {
+	key := base + "\nAccept-Encoding: " + req.Header.Get("Accept-Encoding")
+	key += "\nCookie: " + strings.Join(req.Header.Values("Cookie"), "; ")
+	for _, name := range vary {
+		key += "\n" + name + ": " + strings.Join(req.Header.Values(name), ", ")
+	}
+	return key
+}
+
+// varyHeaders returns the sorted header names of the Vary header
+func varyHeaders(header http.Header) []string {
+	names := []string{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" && name != "Accept-Encoding" && name != "Cookie" {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the cached entry for the key from memory or disk
+func (cache *ResponseCache) lookup(key string) *cacheEntry {
+	if key == "" {
+		return nil
+	}
+
+	cache.mutex.Lock()
+	element, ok := cache.entries[key]
+	if ok {
+		cache.lru.MoveToFront(element)
+	}
+	cache.mutex.Unlock()
+
+	if ok {
+		return element.Value.(*cacheEntry)
+	}
+
+	if cache.Directory == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(cache.file(key))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil || entry.Key != key {
+		return nil
+	}
+
+	cache.add(entry)
+	return entry
+}
+
+// store adds the response to the cache if it may be cached
+func (cache *ResponseCache) store(key string, resp *http.Response, body []byte) {
+	expires, ok := cache.expiry(resp)
+	if !ok {
+		return
+	}
+
+	entry := &cacheEntry{
+		Key:     key,
+		Status:  resp.StatusCode,
+		Header:  resp.Header.Clone(),
+		Body:    body,
+		Stored:  time.Now(),
+		Expires: expires,
+	}
+	entry.Header.Del("Set-Cookie")
+
+	cache.add(entry)
+	cache.persist(entry)
+}
+
+// refresh replaces a cached entry after the upstream confirmed it with "304 Not Modified"
+func (cache *ResponseCache) refresh(entry *cacheEntry, resp *http.Response) {
+	expires, ok := cache.expiry(resp)
+	if !ok {
+		expires = time.Now()
+	}
+
+	refreshed := *entry
+	refreshed.Header = entry.Header.Clone()
+	refreshed.Stored = time.Now()
+	refreshed.Expires = expires
+	for _, name := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+		if value := resp.Header.Get(name); value != "" {
+			refreshed.Header.Set(name, value)
+		}
+	}
+
+	cache.add(&refreshed)
+	cache.persist(&refreshed)
+}
+
+// storable returns whether the response to the request with the given key may be stored. Responses marked private
+// are only stored if the cache is configured to be private.
+func (cache *ResponseCache) storable(key string, resp *http.Response) bool {
+	if key == "" || resp.StatusCode != 200 {
+		return false
+	}
+	if resp.Header.Get("Vary") == "*" {
+		return false
+	}
+	if !cache.Private {
+		for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "private" || strings.HasPrefix(directive, "private=") {
+				return false
+			}
+		}
+	}
+	_, ok := cache.expiry(resp)
+	return ok
+}
+
+// expiry returns when the response must be revalidated, the second value is false for responses that must not be stored
+func (cache *ResponseCache) expiry(resp *http.Response) (time.Time, bool) {
+	now := time.Now()
+	if cache.TTL > 0 {
+		return now.Add(time.Duration(cache.TTL)), true
+	}
+
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store":
+			return now, false
+		case directive == "no-cache":
+			return now, true
+		case strings.HasPrefix(directive, "max-age="):
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil {
+				return now.Add(time.Duration(seconds) * time.Second), true
+			}
+		}
+	}
+
+	expires, err := http.ParseTime(resp.Header.Get("Expires"))
+	if err == nil {
+		return expires, true
+	}
+
+	// Without caching headers the response is stored but always revalidated
+	return now, true
+}
+
+func (cache *ResponseCache) add(entry *cacheEntry) {
+	size := int64(len(entry.Body))
+	if size > cache.MaxSize {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if element, ok := cache.entries[entry.Key]; ok {
+		cache.size -= int64(len(element.Value.(*cacheEntry).Body))
+		cache.lru.Remove(element)
+	}
+
+	cache.entries[entry.Key] = cache.lru.PushFront(entry)
+	cache.size += size
+
+	for cache.size > cache.MaxSize {
+		oldest := cache.lru.Back()
+		removed := cache.lru.Remove(oldest).(*cacheEntry)
+		delete(cache.entries, removed.Key)
+		cache.size -= int64(len(removed.Body))
+	}
+}
+
+func (cache *ResponseCache) persist(entry *cacheEntry) {
+	if cache.Directory == "" {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err == nil {
+		err = ioutil.WriteFile(cache.file(entry.Key), data, 0644)
+	}
+	if err != nil {
+		logError("Could not store cache entry: %s\n", err.Error())
+	}
+}
+
+func (cache *ResponseCache) file(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(cache.Directory, hex.EncodeToString(hash[:])+".json")
+}
+
+// purge removes all entries from memory and disk
+func (cache *ResponseCache) purge() error {
+	cache.mutex.Lock()
+	cache.entries = map[string]*list.Element{}
+	cache.lru.Init()
+	cache.size = 0
+	cache.vary = map[string][]string{}
+	cache.mutex.Unlock()
+
+	if cache.Directory == "" {
+		return nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(cache.Directory, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		err = os.Remove(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/////////////////////////////// Cache Entries ///////////////////////////////
+
+// fresh returns whether the entry can be served without revalidation
+func (entry *cacheEntry) fresh() bool {
+	return time.Now().Before(entry.Expires)
+}
+
+// staleUsable returns whether the entry may be served when the upstream fails
+func (entry *cacheEntry) staleUsable(cache *ResponseCache) bool {
+	return cache.StaleIfError <= 0 || time.Since(entry.Expires) < time.Duration(cache.StaleIfError)
+}
+
+// addConditions makes the request conditional so the upstream can confirm the cached entry
+func (entry *cacheEntry) addConditions(req *http.Request) {
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if modified := entry.Header.Get("Last-Modified"); modified != "" {
+		req.Header.Set("If-Modified-Since", modified)
+	}
+}
+
+// write sends the cached response to the client, the X-Cache header contains the given state
+func (entry *cacheEntry) write(w http.ResponseWriter, state string) {
+	for name, values := range entry.Header {
+		if name == "Content-Length" {
+			continue
+		}
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.Header().Set("X-Cache", state)
+
+	w.WriteHeader(entry.Status)
+	w.Write(entry.Body)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		private  bool
+		method   string
+		header   http.Header
+		vary     string
+		expected string
+	}{
+		{"get", false, "GET", nil, "",
+			"a?b=1&c=2\nAccept-Encoding: \nCookie: "},
+		{"post", false, "POST", nil, "", ""},
+		{"head", false, "HEAD", nil, "", ""},
+		{"authorization", false, "GET", http.Header{"Authorization": {"Basic x"}}, "", ""},
+		{"authorization private", true, "GET", http.Header{"Authorization": {"Basic x"}}, "",
+			"a?b=1&c=2\nAccept-Encoding: \nCookie: "},
+		{"encoding and cookies", false, "GET",
+			http.Header{"Accept-Encoding": {"gzip"}, "Cookie": {"a=1", "b=2"}}, "",
+			"a?b=1&c=2\nAccept-Encoding: gzip\nCookie: a=1; b=2"},
+		{"vary", false, "GET",
+			http.Header{"Accept-Language": {"de"}, "X-Tenant": {"t1", "t2"}}, "x-tenant, Accept-Language",
+			"a?b=1&c=2\nAccept-Encoding: \nCookie: \nAccept-Language: de\nX-Tenant: t1, t2"},
+		{"vary on encoding and cookie", false, "GET",
+			http.Header{"Accept-Encoding": {"br"}, "Cookie": {"s=1"}}, "Accept-Encoding, Cookie",
+			"a?b=1&c=2\nAccept-Encoding: br\nCookie: s=1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proxy := &Proxy{URLFrom: "/p/"}
+			cache := &ResponseCache{Private: test.private}
+			if err := cache.init(); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(test.method, "/p/a?c=2&b=1", nil)
+			for name, values := range test.header {
+				req.Header[name] = values
+			}
+			if test.vary != "" {
+				resp := &http.Response{Header: http.Header{"Vary": {test.vary}}}
+				if key := cache.storeKey(proxy, req, resp); key != test.expected {
+					t.Errorf("storeKey = %q, want %q", key, test.expected)
+				}
+			}
+
+			if key := cache.key(proxy, req); key != test.expected {
+				t.Errorf("key = %q, want %q", key, test.expected)
+			}
+		})
+	}
+}
+
+func TestCacheKeyVariants(t *testing.T) {
+	proxy := &Proxy{URLFrom: "/p/"}
+	cache := &ResponseCache{}
+	cache.init()
+
+	request := func(language string, cookie string) *http.Request {
+		req := httptest.NewRequest("GET", "/p/a", nil)
+		req.Header.Set("Accept-Language", language)
+		req.Header.Set("Cookie", cookie)
+		return req
+	}
+
+	// Before the response is known, only encoding and cookies distinguish the requests
+	if cache.key(proxy, request("de", "")) != cache.key(proxy, request("en", "")) {
+		t.Error("keys differ before the Vary header is known")
+	}
+	if cache.key(proxy, request("de", "s=1")) == cache.key(proxy, request("de", "s=2")) {
+		t.Error("keys of different sessions are equal")
+	}
+
+	cache.storeKey(proxy, request("de", ""), &http.Response{Header: http.Header{"Vary": {"Accept-Language"}}})
+	if cache.key(proxy, request("de", "")) == cache.key(proxy, request("en", "")) {
+		t.Error("keys are equal although the response varies on the language")
+	}
+}
+
+func TestCacheVaryPersisted(t *testing.T) {
+	proxy := &Proxy{URLFrom: "/p/"}
+	directory := t.TempDir()
+	req := httptest.NewRequest("GET", "/p/a", nil)
+	req.Header.Set("X-Tenant", "t1")
+
+	cache := &ResponseCache{Directory: directory}
+	cache.init()
+	key := cache.storeKey(proxy, req, &http.Response{Header: http.Header{"Vary": {"X-Tenant"}}})
+	cache.store(key, &http.Response{StatusCode: 200, Header: http.Header{"Cache-Control": {"max-age=60"}}},
+		[]byte("body"))
+
+	// A new cache on the same directory finds the entry stored for the variant
+	restarted := &ResponseCache{Directory: directory}
+	restarted.init()
+	if restartedKey := restarted.key(proxy, req); restartedKey != key {
+		t.Fatalf("key after restart = %q, want %q", restartedKey, key)
+	}
+	entry := restarted.lookup(key)
+	if entry == nil || string(entry.Body) != "body" || !entry.fresh() {
+		t.Errorf("entry not found after restart: %+v", entry)
+	}
+}
+
+func TestVaryHeaders(t *testing.T) {
+	tests := []struct {
+		vary     []string
+		expected []string
+	}{
+		{nil, []string{}},
+		{[]string{"Accept-Encoding"}, []string{}},
+		{[]string{"cookie, accept-encoding"}, []string{}},
+		{[]string{"x-b, Accept-Language", "X-A"}, []string{"Accept-Language", "X-A", "X-B"}},
+		{[]string{" , X-A,"}, []string{"X-A"}},
+	}
+
+	for _, test := range tests {
+		names := varyHeaders(http.Header{"Vary": test.vary})
+		if len(names) != len(test.expected) {
+			t.Errorf("varyHeaders(%q) = %q, want %q", test.vary, names, test.expected)
+			continue
+		}
+		for i := range names {
+			if names[i] != test.expected[i] {
+				t.Errorf("varyHeaders(%q) = %q, want %q", test.vary, names, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestCacheStorable(t *testing.T) {
+	tests := []struct {
+		name     string
+		private  bool
+		key      string
+		status   int
+		header   http.Header
+		storable bool
+	}{
+		{"plain", false, "k", 200, http.Header{}, true},
+		{"no key", false, "", 200, http.Header{}, false},
+		{"not found", false, "k", 404, http.Header{}, false},
+		{"vary star", false, "k", 200, http.Header{"Vary": {"*"}}, false},
+		{"vary star private", true, "k", 200, http.Header{"Vary": {"*"}}, false},
+		{"no-store", false, "k", 200, http.Header{"Cache-Control": {"no-store"}}, false},
+		{"no-cache", false, "k", 200, http.Header{"Cache-Control": {"no-cache"}}, true},
+		{"private", false, "k", 200, http.Header{"Cache-Control": {"max-age=60, Private"}}, false},
+		{"private fields", false, "k", 200, http.Header{"Cache-Control": {`private="Set-Cookie"`}}, false},
+		{"private cache", true, "k", 200, http.Header{"Cache-Control": {"private, max-age=60"}}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := &ResponseCache{Private: test.private}
+			cache.init()
+			resp := &http.Response{StatusCode: test.status, Header: test.header}
+			if storable := cache.storable(test.key, resp); storable != test.storable {
+				t.Errorf("storable = %t, want %t", storable, test.storable)
+			}
+		})
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name    string
+		ttl     time.Duration
+		header  http.Header
+		expires time.Duration
+		ok      bool
+	}{
+		{"no headers", 0, http.Header{}, 0, true},
+		{"max-age", 0, http.Header{"Cache-Control": {"public, max-age=60"}}, time.Minute, true},
+		{"invalid max-age", 0, http.Header{"Cache-Control": {"max-age=x"}}, 0, true},
+		{"no-cache", 0, http.Header{"Cache-Control": {"no-cache, max-age=60"}}, 0, true},
+		{"no-store", 0, http.Header{"Cache-Control": {"no-store"}}, 0, false},
+		{"expires", 0, http.Header{"Expires": {future.Format(http.TimeFormat)}}, time.Until(future), true},
+		{"ttl", time.Hour, http.Header{"Cache-Control": {"no-store"}}, time.Hour, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := &ResponseCache{TTL: Duration(test.ttl)}
+			cache.init()
+			expires, ok := cache.expiry(&http.Response{Header: test.header})
+			if ok != test.ok {
+				t.Fatalf("ok = %t, want %t", ok, test.ok)
+			}
+			if !ok {
+				return
+			}
+			if difference := time.Until(expires) - test.expires; difference > 2*time.Second || difference < -2*time.Second {
+				t.Errorf("expires in %s, want %s", time.Until(expires), test.expires)
+			}
+		})
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	tests := []struct {
+		name         string
+		staleIfError time.Duration
+		expired      time.Duration
+		fresh        bool
+		usable       bool
+	}{
+		{"fresh", time.Minute, -time.Minute, true, true},
+		{"unlimited", 0, 24 * time.Hour, false, true},
+		{"within the limit", time.Minute, 30 * time.Second, false, true},
+		{"beyond the limit", time.Minute, 2 * time.Minute, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache := &ResponseCache{StaleIfError: Duration(test.staleIfError)}
+			entry := &cacheEntry{Expires: time.Now().Add(-test.expired)}
+			if entry.fresh() != test.fresh {
+				t.Errorf("fresh = %t, want %t", entry.fresh(), test.fresh)
+			}
+			if entry.staleUsable(cache) != test.usable {
+				t.Errorf("staleUsable = %t, want %t", entry.staleUsable(cache), test.usable)
+			}
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	cache := &ResponseCache{MaxSize: 10}
+	cache.init()
+	resp := &http.Response{StatusCode: 200, Header: http.Header{"Set-Cookie": {"s=1"}}}
+
+	cache.store("a", resp, []byte("12345"))
+	cache.store("b", resp, []byte("12345"))
+	cache.lookup("a")
+	cache.store("c", resp, []byte("12345"))
+	cache.store("too large", resp, []byte("12345678901"))
+
+	if cache.lookup("b") != nil || cache.lookup("too large") != nil {
+		t.Error("least recently used or oversized entry is still cached")
+	}
+	entry := cache.lookup("a")
+	if entry == nil || cache.lookup("c") == nil {
+		t.Fatal("recently used entries were evicted")
+	}
+	if entry.Header.Get("Set-Cookie") != "" {
+		t.Error("Set-Cookie must not be cached")
+	}
+}
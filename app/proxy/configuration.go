@@ -7,15 +7,24 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // Configuration contains all data needed for the proxy to run
 type Configuration struct {
-	Proxies   map[string]*Proxy  `json:"proxies"`
-	Plugins   map[string]*Plugin `json:"plugins"`
-	serverDir string
-	port      int
-	active    bool
+	Proxies       map[string]*Proxy  `json:"proxies"`
+	Plugins       map[string]*Plugin `json:"plugins"`
+	Admin         string             `json:"admin"`
+	HAR           *HARLog            `json:"har"`
+	UpstreamProxy string             `json:"upstream-proxy"`
+	NoProxy       string             `json:"no-proxy"`
+	Static        RouteOptions       `json:"static"`
+	Hooks         []*Hook            `json:"hooks"`
+	Timeouts      *Timeouts          `json:"timeouts"`
+	TLS           *ServerTLS         `json:"tls"`
+	serverDir     string
+	port          int
+	active        bool
 }
 
 func initConfiguration() *Configuration {
@@ -90,16 +99,126 @@ func initConfiguration() *Configuration {
 		urls[path] = true
 	}
 
+	config.Timeouts = config.Timeouts.merge(&defaultTimeouts)
+
 	// Initialize proxies
 	for path, proxy := range config.Proxies {
-		proxy.client = createClient(proxy.Insecure)
 		proxy.URLFrom = path
+		proxy.CircuitBreaker.init(path)
+
+		err = proxy.RouteOptions.init(path, config.Timeouts.routeDefaults())
+		if err == nil {
+			err = proxy.initGRPC()
+		}
+		if err == nil {
+			err = proxy.initUpstreams()
+		}
+		if err == nil {
+			err = proxy.Mirror.init()
+		}
+		if err == nil {
+			proxy.client, err = createClient(config, proxy)
+		}
+		if err == nil {
+			err = proxy.Record.init()
+		}
+		if err == nil {
+			err = proxy.Cache.init()
+		}
+		if err == nil {
+			err = proxy.Forwarded.init()
+		}
+		if err == nil {
+			err = proxy.Fallback.init(config, proxy)
+		}
+		if err == nil {
+			err = proxy.Filter.init(config, proxy)
+		}
+		proxy.CSRF.init()
+		if err != nil {
+			logFatal(ExitcodeProxyConfig, "Proxy \"%s\": %s\n", path, err.Error())
+		}
+
+		if proxy.HealthCheck != nil {
+			go proxy.runHealthChecks()
+		}
+	}
+
+	err = config.HAR.init()
+	if err != nil {
+		logFatal(ExitcodeHARFile, "HAR file: %s\n", err.Error())
+	}
+
+	err = config.Static.init("/", config.Timeouts)
+	if err != nil {
+		logFatal(ExitcodeStaticConfig, "Static files: %s\n", err.Error())
 	}
 
 	// Initialize plugin
 	for path, plugin := range config.Plugins {
 		plugin.URLFrom = path
+
+		err = plugin.RouteOptions.init(path, config.Timeouts.routeDefaults())
+		if err != nil {
+			logFatal(ExitcodePluginConfig, "Plugin \"%s\": %s\n", path, err.Error())
+		}
+	}
+
+	// Initialize hooks
+	for i, hook := range config.Hooks {
+		err = hook.init(config)
+		if err != nil {
+			logFatal(ExitcodeHookConfig, "Hook %d: %s\n", i+1, err.Error())
+		}
 	}
 
 	return config
 }
+
+// routeOptions returns the options of all proxies, plugins and the static files
+func (config *Configuration) routeOptions() []*RouteOptions {
+	options := []*RouteOptions{&config.Static}
+	for _, proxy := range config.Proxies {
+		options = append(options, &proxy.RouteOptions)
+	}
+	for _, plugin := range config.Plugins {
+		options = append(options, &plugin.RouteOptions)
+	}
+	return options
+}
+
+// Duration is a time.Duration that can be given in the configuration either as a string like "1m30s" or as a
+// number of seconds
+type Duration time.Duration
+
+// UnmarshalJSON implements json.Unmarshaler
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	err := json.Unmarshal(data, &value)
+	if err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration: %s", string(data))
+	}
+
+	return nil
+}
+
+// Or returns the duration or the given default value if it is not set
+func (d Duration) Or(defaultValue time.Duration) time.Duration {
+	if d <= 0 {
+		return defaultValue
+	}
+	return time.Duration(d)
+}
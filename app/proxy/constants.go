@@ -20,6 +20,11 @@ Exit codes:
    3 - Configuration file cannot be parsed (invalid JSON)
    4 - Server directory is either not valid or not a directory
    5 - Not all proxy/plugin URLs are unique
+   6 - Proxy configuration is invalid
+   7 - HAR file cannot be created
+   8 - Plugin configuration is invalid
+   9 - Static file configuration is invalid
+  10 - Hook configuration is invalid
 `
 
 const (
@@ -29,6 +34,31 @@ const (
 	PluginTypeCGI = "cgi"
 )
 
+const (
+	// BalanceRoundRobin distributes requests evenly over all available upstreams
+	BalanceRoundRobin = "round-robin"
+	// BalanceLeastConnections sends requests to the upstream with the fewest active requests
+	BalanceLeastConnections = "least-connections"
+	// BalanceRandom sends requests to a randomly chosen upstream
+	BalanceRandom = "random"
+	// BalanceWeighted distributes requests according to the upstream weights
+	BalanceWeighted = "weighted"
+)
+
+const (
+	// GRPCModeProxy forwards gRPC requests over HTTP/2
+	GRPCModeProxy = "proxy"
+	// GRPCModeWeb additionally translates gRPC-Web requests from browsers to gRPC
+	GRPCModeWeb = "web"
+)
+
+const (
+	// HookHeaderPath in the output of a hook changes the path (and query) of the request
+	HookHeaderPath = "X-Hook-Path"
+	// HookHeaderUpstream in the output of a hook sends the request to the given upstream URL
+	HookHeaderUpstream = "X-Hook-Upstream"
+)
+
 // The following exit codes are possible in case of errors
 const (
 	ExitcodeConfigPath   = 1
@@ -36,6 +66,11 @@ const (
 	ExitcodeParseConfig  = 3
 	ExitcodeServerDir    = 4
 	ExitcodeURLNotUnique = 5
+	ExitcodeProxyConfig  = 6
+	ExitcodeHARFile      = 7
+	ExitcodePluginConfig = 8
+	ExitcodeStaticConfig = 9
+	ExitcodeHookConfig   = 10
 )
 
 // TODO: Document exit codes for the user
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// CORSPolicy describes which cross-origin requests are allowed for a route
+type CORSPolicy struct {
+	Origins       []string `json:"origins"`
+	Methods       []string `json:"methods"`
+	Headers       []string `json:"headers"`
+	ExposeHeaders []string `json:"expose-headers"`
+	Credentials   bool     `json:"credentials"`
+	MaxAge        Duration `json:"max-age"`
+
+	patterns []*regexp.Regexp
+}
+
+// corsWriter replaces the CORS headers of the response with the ones of the policy
+type corsWriter struct {
+	http.ResponseWriter
+	policy      *CORSPolicy
+	origin      string
+	wroteHeader bool
+}
+
+/////////////////////////////// CORS ///////////////////////////////
+
+func (policy *CORSPolicy) init() error {
+	if policy == nil {
+		return nil
+	}
+	if len(policy.Origins) == 0 {
+		policy.Origins = []string{"*"}
+	}
+	if len(policy.Methods) == 0 {
+		policy.Methods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	}
+
+	for _, origin := range policy.Origins {
+		// Any site could make credentialed requests otherwise
+		if policy.Credentials && origin == "*" {
+			return fmt.Errorf("CORS credentials require a list of origins, \"*\" is not allowed")
+		}
+
+		// "*" matches any character sequence, for example "https://*.example.com"
+		pattern := "^" + strings.ReplaceAll(regexp.QuoteMeta(origin), `\*`, ".*") + "$"
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid CORS origin \"%s\": %s", origin, err.Error())
+		}
+		policy.patterns = append(policy.patterns, compiled)
+	}
+
+	return nil
+}
+
+// allows returns whether requests from the origin are allowed
+func (policy *CORSPolicy) allows(origin string) bool {
+	for _, pattern := range policy.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin returns the value of the Access-Control-Allow-Origin header for the origin
+func (policy *CORSPolicy) allowOrigin(origin string) string {
+	if !policy.Credentials && len(policy.Origins) == 1 && policy.Origins[0] == "*" {
+		return "*"
+	}
+	return origin
+}
+
+// handlePreflight answers CORS preflight requests locally, it returns false for all other requests
+func (policy *CORSPolicy) handlePreflight(w http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if req.Method != "OPTIONS" || origin == "" || req.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+
+	w.Header().Add("Vary", "Origin")
+	if !policy.allows(origin) {
+		logDebug("CORS preflight from origin %s rejected for %s\n", origin, req.URL.Path)
+		w.WriteHeader(403)
+		w.Write([]byte(fmt.Sprintf("CORS Error: origin %s is not allowed\n", origin)))
+		return true
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", policy.allowOrigin(origin))
+	w.Header().Set("Access-Control-Allow-Methods", strings.Join(policy.Methods, ", "))
+	if len(policy.Headers) > 0 {
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(policy.Headers, ", "))
+	} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		w.Header().Set("Access-Control-Allow-Headers", requested)
+	}
+	if policy.Credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if policy.MaxAge > 0 {
+		w.Header().Set("Access-Control-Max-Age", fmt.Sprintf("%d", time.Duration(policy.MaxAge)/time.Second))
+	}
+
+	w.WriteHeader(204)
+	return true
+}
+
+// wrap returns a response writer setting the CORS headers of the policy
+func (policy *CORSPolicy) wrap(w http.ResponseWriter, req *http.Request) http.ResponseWriter {
+	return &corsWriter{ResponseWriter: w, policy: policy, origin: req.Header.Get("Origin")}
+}
+
+func (cw *corsWriter) WriteHeader(status int) {
+	if !cw.wroteHeader && status >= 200 {
+		cw.wroteHeader = true
+
+		// Headers set by the upstream or plugin are replaced by the policy
+		header := cw.Header()
+		for name := range header {
+			if strings.HasPrefix(name, "Access-Control-") {
+				header.Del(name)
+			}
+		}
+
+		if cw.origin != "" && cw.policy.allows(cw.origin) {
+			header.Add("Vary", "Origin")
+			header.Set("Access-Control-Allow-Origin", cw.policy.allowOrigin(cw.origin))
+			if cw.policy.Credentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if len(cw.policy.ExposeHeaders) > 0 {
+				header.Set("Access-Control-Expose-Headers", strings.Join(cw.policy.ExposeHeaders, ", "))
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *corsWriter) Write(data []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(200)
+	}
+	return cw.ResponseWriter.Write(data)
+}
+
+// Flush implements http.Flusher
+func (cw *corsWriter) Flush() {
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped response writer for http.ResponseController
+func (cw *corsWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// CSRFHandling describes how CSRF tokens are fetched from the upstreams and added to modifying requests
+type CSRFHandling struct {
+	Header    string   `json:"header"`
+	FetchPath string   `json:"fetch-path"`
+	Methods   []string `json:"methods"`
+
+	mutex  sync.Mutex
+	tokens map[string]string
+}
+
+// maxCSRFSessions limits the number of cached tokens, all tokens are fetched again once it is exceeded
+const maxCSRFSessions = 1000
+
+/////////////////////////////// CSRF Tokens ///////////////////////////////
+
+func (csrf *CSRFHandling) init() {
+	if csrf == nil {
+		return
+	}
+	if csrf.Header == "" {
+		csrf.Header = "X-CSRF-Token"
+	}
+	if len(csrf.Methods) == 0 {
+		csrf.Methods = []string{"POST", "PUT", "PATCH", "DELETE"}
+	}
+	csrf.tokens = map[string]string{}
+}
+
+// protects returns whether requests with the given method need a CSRF token
+func (csrf *CSRFHandling) protects(method string) bool {
+	if csrf == nil {
+		return false
+	}
+	for _, m := range csrf.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// do sends the request with the CSRF token of the upstream session. If the upstream rejects the token, a new token
+// is fetched and the request is sent once more.
+func (csrf *CSRFHandling) do(proxy *Proxy, upstream *Upstream, req *http.Request) (*http.Response, error) {
+	if !csrf.protects(req.Method) {
+		return proxy.client.Do(req)
+	}
+
+	token, err := csrf.token(proxy, upstream, req, false)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set(csrf.Header, token)
+	}
+
+	resp, err := proxy.client.Do(req)
+	if err != nil || resp.StatusCode != 403 || !strings.EqualFold(resp.Header.Get(csrf.Header), "Required") {
+		return resp, err
+	}
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return resp, err
+	}
+
+	logDebug("CSRF token for %s was rejected, fetching a new one\n", upstream.URL)
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	token, err = csrf.token(proxy, upstream, req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	retryReq := req.Clone(req.Context())
+	if req.GetBody != nil {
+		retryReq.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	retryReq.Header.Set(csrf.Header, token)
+
+	return proxy.client.Do(retryReq)
+}
+
+// token returns the cached CSRF token of the session or fetches a new one with a GET request. The session consists
+// of the cookie jar of the proxy and the cookies of the client, which are sent to the upstream as well.
+func (csrf *CSRFHandling) token(proxy *Proxy, upstream *Upstream, req *http.Request, refetch bool) (string, error) {
+	csrf.mutex.Lock()
+	defer csrf.mutex.Unlock()
+
+	cookies := strings.Join(req.Header.Values("Cookie"), "; ")
+	session := upstream.id + "\n" + cookies
+	if token, ok := csrf.tokens[session]; ok && !refetch {
+		return token, nil
+	}
+
+	fetchURL := strings.TrimSuffix(upstream.address, "/") + "/" + strings.TrimPrefix(csrf.FetchPath, "/")
+	fetchReq, err := http.NewRequest("GET", fetchURL, nil)
+	if err != nil {
+		return "", err
+	}
+	fetchReq.Header.Set(csrf.Header, "Fetch")
+	if cookies != "" {
+		fetchReq.Header.Set("Cookie", cookies)
+	}
+
+	query := fetchReq.URL.Query()
+	for key, value := range proxy.Parameters {
+		query.Set(key, value)
+	}
+	fetchReq.URL.RawQuery = query.Encode()
+
+	// The token belongs to the session in the cookie jar of the proxy client and the client cookies
+	resp, err := proxy.client.Do(fetchReq)
+	if err != nil {
+		return "", err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	token := resp.Header.Get(csrf.Header)
+	if token == "" {
+		// Try again with the next request
+		logError("No CSRF token received from %s (status %d)\n", fetchURL, resp.StatusCode)
+		return "", nil
+	}
+
+	logDebug("Fetched CSRF token from %s\n", fetchURL)
+	if len(csrf.tokens) >= maxCSRFSessions {
+		csrf.tokens = map[string]string{}
+	}
+	csrf.tokens[session] = token
+	return token, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Fallback describes the responses used when the upstreams of a proxy entry are unavailable
+type Fallback struct {
+	Recorded  bool          `json:"recorded"`
+	Directory string        `json:"directory"`
+	Plugin    string        `json:"plugin"`
+	Mock      *MockResponse `json:"mock"`
+	Status    []int         `json:"status"`
+	Header    string        `json:"header"`
+
+	config *Configuration
+	plugin *Plugin
+}
+
+// The sources of fallback responses as given in the fallback header
+const (
+	fallbackRecorded  = "recorded"
+	fallbackDirectory = "directory"
+	fallbackPlugin    = "plugin"
+	fallbackMock      = "mock"
+)
+
+/////////////////////////////// Fallback ///////////////////////////////
+
+func (fallback *Fallback) init(config *Configuration, proxy *Proxy) error {
+	if fallback == nil {
+		return nil
+	}
+	if fallback.Header == "" {
+		fallback.Header = "X-Fallback"
+	}
+	if fallback.Recorded && proxy.Record == nil {
+		return errors.New("recorded fallback responses require a record configuration")
+	}
+	if fallback.Plugin != "" {
+		fallback.plugin = config.Plugins[fallback.Plugin]
+		if fallback.plugin == nil {
+			return fmt.Errorf("unknown fallback plugin \"%s\"", fallback.Plugin)
+		}
+	}
+	fallback.config = config
+	return nil
+}
+
+// applies returns whether the result of the upstream request should be replaced by a fallback response. Connection
+// errors and timeouts always use the fallback, upstream responses only if their status is configured.
+func (fallback *Fallback) applies(resp *http.Response, err error) bool {
+	if fallback == nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	for _, status := range fallback.Status {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// serve sends the first available fallback response, it returns false if none of the sources has a response for the
+// request. The request body is only available for plugins if it was buffered.
+func (fallback *Fallback) serve(proxy *Proxy, w http.ResponseWriter, req *http.Request, recordFile string, body []byte) bool {
+	header := w.Header()
+
+	if fallback.Recorded && recordFile != "" {
+		header.Set(fallback.Header, fallbackRecorded)
+		if proxy.Record.replay(recordFile, w) {
+			return true
+		}
+		header.Del(fallback.Header)
+	}
+
+	if fallback.Directory != "" {
+		file := filepath.Join(fallback.Directory, filepath.FromSlash(path.Clean("/"+strings.TrimPrefix(req.URL.Path, proxy.URLFrom))))
+		if info, err := os.Stat(file); err == nil && info.Mode().IsRegular() {
+			header.Set(fallback.Header, fallbackDirectory)
+			http.ServeFile(w, req, file)
+			return true
+		}
+	}
+
+	if fallback.plugin != nil {
+		if body != nil {
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			req.ContentLength = int64(len(body))
+		}
+		header.Set(fallback.Header, fallbackPlugin)
+		executePlugin(fallback.config, fallback.plugin, w, req)
+		return true
+	}
+
+	if fallback.Mock != nil {
+		header.Set(fallback.Header, fallbackMock)
+		fallback.Mock.write(w)
+		return true
+	}
+
+	return false
+}
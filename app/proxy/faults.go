@@ -0,0 +1,177 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// FaultInjection describes the latency, errors and slow or broken responses simulated for a route
+type FaultInjection struct {
+	Disabled     bool     `json:"disabled"`
+	Latency      Duration `json:"latency"`
+	LatencyMax   Duration `json:"latency-max"`
+	ErrorRate    float64  `json:"error-rate"`
+	ErrorStatus  int      `json:"error-status"`
+	ResetRate    float64  `json:"reset-rate"`
+	TruncateRate float64  `json:"truncate-rate"`
+	TruncateAt   int64    `json:"truncate-at"`
+	Bandwidth    int64    `json:"bandwidth"`
+
+	enabled int32
+}
+
+// faultWriter truncates and throttles the response body
+type faultWriter struct {
+	http.ResponseWriter
+	faults    *FaultInjection
+	remaining int64
+	truncated bool
+}
+
+/////////////////////////////// Fault Injection ///////////////////////////////
+
+func (faults *FaultInjection) init() error {
+	if faults == nil {
+		return nil
+	}
+	if faults.ErrorStatus == 0 {
+		faults.ErrorStatus = 503
+	}
+	faults.enable(!faults.Disabled)
+	return nil
+}
+
+// active returns whether faults are currently injected
+func (faults *FaultInjection) active() bool {
+	return faults != nil && atomic.LoadInt32(&faults.enabled) == 1
+}
+
+// enable switches the fault injection on or off at runtime
+func (faults *FaultInjection) enable(enabled bool) {
+	var value int32
+	if enabled {
+		value = 1
+	}
+	atomic.StoreInt32(&faults.enabled, value)
+}
+
+// chance returns true for the given percentage of calls
+func chance(percentage float64) bool {
+	return percentage > 0 && rand.Float64()*100 < percentage
+}
+
+// delay returns the latency added to a request, a random value between latency and latency-max if both are set
+func (faults *FaultInjection) delay() time.Duration {
+	delay := time.Duration(faults.Latency)
+	if faults.LatencyMax > faults.Latency {
+		delay += time.Duration(rand.Int63n(int64(faults.LatencyMax - faults.Latency)))
+	}
+	return delay
+}
+
+// handle injects the configured faults into the handling of the request
+func (faults *FaultInjection) handle(w http.ResponseWriter, req *http.Request, next func(http.ResponseWriter)) {
+	if delay := faults.delay(); delay > 0 {
+		logDebug("Fault injection: delaying %s by %s\n", req.URL.Path, delay)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	if chance(faults.ResetRate) {
+		logDebug("Fault injection: resetting connection for %s\n", req.URL.Path)
+		// Closes the connection without sending a response
+		panic(http.ErrAbortHandler)
+	}
+
+	if chance(faults.ErrorRate) {
+		logDebug("Fault injection: failing %s with status %d\n", req.URL.Path, faults.ErrorStatus)
+		w.WriteHeader(faults.ErrorStatus)
+		w.Write([]byte("Injected Fault: " + http.StatusText(faults.ErrorStatus) + "\n"))
+		return
+	}
+
+	writer := &faultWriter{ResponseWriter: w, faults: faults, remaining: -1}
+	if chance(faults.TruncateRate) {
+		writer.remaining = faults.TruncateAt
+	}
+
+	next(writer)
+
+	if writer.truncated {
+		logDebug("Fault injection: truncated response for %s after %d bytes\n", req.URL.Path, faults.TruncateAt)
+		// The connection is closed, so the client cannot mistake the truncated body for a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func (writer *faultWriter) Write(data []byte) (int, error) {
+	if writer.truncated {
+		return 0, http.ErrAbortHandler
+	}
+	length := len(data)
+	if writer.remaining >= 0 && int64(length) > writer.remaining {
+		data = data[:writer.remaining]
+		writer.truncated = true
+	}
+	if writer.remaining >= 0 {
+		writer.remaining -= int64(len(data))
+	}
+
+	written, err := writer.throttle(data)
+	if err == nil && writer.truncated {
+		writer.Flush()
+		err = http.ErrAbortHandler
+	}
+	if err != nil {
+		return written, err
+	}
+	return length, nil
+}
+
+// throttle writes the data in chunks limited to the configured bandwidth in bytes per second
+func (writer *faultWriter) throttle(data []byte) (int, error) {
+	bandwidth := writer.faults.Bandwidth
+	if bandwidth <= 0 {
+		return writer.ResponseWriter.Write(data)
+	}
+
+	// Chunks of a tenth of the bandwidth are sent every 100ms
+	chunk := bandwidth / 10
+	if chunk < 1 {
+		chunk = 1
+	}
+	written := 0
+	for len(data) > 0 {
+		size := int64(len(data))
+		if size > chunk {
+			size = chunk
+		}
+		started := time.Now()
+		n, err := writer.ResponseWriter.Write(data[:size])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		writer.Flush()
+		data = data[size:]
+		time.Sleep(time.Duration(size)*time.Second/time.Duration(bandwidth) - time.Since(started))
+	}
+	return written, nil
+}
+
+// Flush implements http.Flusher
+func (writer *faultWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped response writer for http.ResponseController
+func (writer *faultWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
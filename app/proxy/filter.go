@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// ResponseFilter describes an executable post-processing the upstream responses of a proxy. It is configured like
+// a plugin: the upstream body is passed on stdin, the output replaces the response. With the type "cgi" the output
+// may start with CGI headers (including Status) which replace the upstream headers.
+type ResponseFilter struct {
+	Type        PluginType `json:"type"`
+	Executable  string     `json:"executable"`
+	Arguments   []string   `json:"arguments"`
+	ContentType string     `json:"content-type"`
+	Log         bool       `json:"log"`
+
+	config *Configuration
+	plugin *Plugin
+}
+
+/////////////////////////////// Response Filter ///////////////////////////////
+
+func (filter *ResponseFilter) init(config *Configuration, proxy *Proxy) error {
+	if filter == nil {
+		return nil
+	}
+	if filter.Executable == "" {
+		return errors.New("filter executable is missing")
+	}
+	if filter.Type != PluginTypeSimple && filter.Type != PluginTypeCGI {
+		return fmt.Errorf("invalid filter type \"%s\"", filter.Type)
+	}
+	if proxy.GRPC != "" {
+		return errors.New("filters cannot be used for gRPC proxies")
+	}
+
+	filter.config = config
+	filter.plugin = &Plugin{
+		Type:       filter.Type,
+		Executable: filter.Executable,
+		Arguments:  filter.Arguments,
+		Log:        filter.Log,
+		URLFrom:    proxy.URLFrom,
+	}
+	filter.plugin.timeouts = proxy.timeouts
+	return nil
+}
+
+// prepare removes the Accept-Encoding header so the filter always receives the decoded body
+func (filter *ResponseFilter) prepare(req *http.Request) {
+	if filter != nil {
+		req.Header.Del("Accept-Encoding")
+	}
+}
+
+// apply runs the filter for the upstream response and returns the filtered response
+func (filter *ResponseFilter) apply(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if filter == nil {
+		return resp, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(filter.plugin.timeouts.Plugin))
+	defer cancel()
+
+	cmd := pluginCommand(ctx, filter.config, filter.plugin, req)
+	cmd.Env = filter.environment(req, resp, len(body))
+	cmd.Stdin = bytes.NewReader(body)
+	errorBuffer := bytes.Buffer{}
+	cmd.Stderr = &errorBuffer
+
+	output, err := cmd.Output()
+	if filter.Log && errorBuffer.Len() > 0 {
+		fmt.Fprintf(os.Stderr, "Filter Error Output: \n |%s\n\n", strings.ReplaceAll(errorBuffer.String(), "\n", "\n |"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := *resp
+	filtered.Header = resp.Header.Clone()
+	filtered.Header.Del("Content-Length")
+	filtered.Header.Del("Content-Encoding")
+	filtered.Header.Del("ETag")
+	if filter.ContentType != "" {
+		filtered.Header.Set("Content-Type", filter.ContentType)
+	}
+	if filter.Type == PluginTypeCGI {
+		var header http.Header
+		filtered.StatusCode, header, output = parseCGIOutput(output, resp.StatusCode)
+		for key, values := range header {
+			filtered.Header[key] = values
+		}
+	}
+	filtered.Status = fmt.Sprintf("%d %s", filtered.StatusCode, http.StatusText(filtered.StatusCode))
+	filtered.ContentLength = int64(len(output))
+	filtered.Header.Set("Content-Length", fmt.Sprintf("%d", len(output)))
+	filtered.Body = ioutil.NopCloser(bytes.NewReader(output))
+	return &filtered, nil
+}
+
+// environment describes the request and the upstream response for the filter
+func (filter *ResponseFilter) environment(req *http.Request, resp *http.Response, length int) []string {
+	env := []string{
+		fmt.Sprintf("REQUEST_METHOD=%s", req.Method),
+		fmt.Sprintf("REQUEST_URI=%s", req.URL.RequestURI()),
+		fmt.Sprintf("PATH_INFO=%s", strings.Replace(req.URL.Path, filter.plugin.URLFrom, "", 1)),
+		fmt.Sprintf("QUERY_STRING=%s", req.URL.RawQuery),
+		fmt.Sprintf("SCRIPT_NAME=%s", filter.plugin.URLFrom),
+		fmt.Sprintf("SERVER_SOFTWARE=%s/%s", AppName, AppVersion),
+		fmt.Sprintf("UPSTREAM_URL=%s", resp.Request.URL.String()),
+		fmt.Sprintf("RESPONSE_STATUS=%d", resp.StatusCode),
+		fmt.Sprintf("CONTENT_LENGTH=%d", length),
+		fmt.Sprintf("CONTENT_TYPE=%s", resp.Header.Get("Content-Type")),
+	}
+
+	// Response headers, named like the CGI request headers
+	return appendHeaderVariables(env, resp.Header)
+}
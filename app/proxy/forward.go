@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// UpstreamProxyDirect disables the use of a forward proxy, even if one is configured in the environment
+const UpstreamProxyDirect = "direct"
+
+/////////////////////////////// Forward Proxies ///////////////////////////////
+
+// forwardProxies contains the forward proxies used to reach the upstreams
+type forwardProxies struct {
+	httpProxy  *url.URL
+	httpsProxy *url.URL
+	noProxy    []string
+}
+
+// createProxyFunc returns the function choosing the forward proxy for requests to the upstreams. The environment
+// variables HTTP_PROXY, HTTPS_PROXY and NO_PROXY are used unless they are overridden by the configuration.
+func createProxyFunc(proxyURI string, noProxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxyURI == UpstreamProxyDirect {
+		return nil, nil
+	}
+
+	httpProxy := getEnv("HTTP_PROXY")
+	httpsProxy := getEnv("HTTPS_PROXY")
+	if proxyURI != "" {
+		httpProxy = proxyURI
+		httpsProxy = proxyURI
+	}
+	if noProxy == "" {
+		noProxy = getEnv("NO_PROXY")
+	}
+
+	forward := &forwardProxies{}
+	var err error
+
+	forward.httpProxy, err = parseProxyURL(httpProxy)
+	if err != nil {
+		return nil, err
+	}
+	forward.httpsProxy, err = parseProxyURL(httpsProxy)
+	if err != nil {
+		return nil, err
+	}
+	if forward.httpProxy == nil && forward.httpsProxy == nil {
+		return nil, nil
+	}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry != "" {
+			forward.noProxy = append(forward.noProxy, entry)
+		}
+	}
+
+	return forward.proxyFor, nil
+}
+
+func (forward *forwardProxies) proxyFor(req *http.Request) (*url.URL, error) {
+	host := strings.ToLower(req.URL.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") || forward.bypass(host, req.URL.Port()) {
+		return nil, nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil, nil
+	}
+
+	if req.URL.Scheme == "https" {
+		return forward.httpsProxy, nil
+	}
+	return forward.httpProxy, nil
+}
+
+// bypass checks the host against the NO_PROXY entries (host names, domains, IP addresses and networks)
+func (forward *forwardProxies) bypass(host string, port string) bool {
+	ip := net.ParseIP(host)
+
+	for _, entry := range forward.noProxy {
+		if entry == "*" {
+			return true
+		}
+
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost = entry
+			entryPort = ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+
+		// Entries match the host itself and all of its subdomains
+		entryHost = strings.TrimPrefix(strings.TrimPrefix(entryHost, "*"), ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseProxyURL parses the proxy URI, the scheme defaults to http
+func parseProxyURL(proxyURI string) (*url.URL, error) {
+	if proxyURI == "" {
+		return nil, nil
+	}
+	if !strings.Contains(proxyURI, "://") {
+		proxyURI = "http://" + proxyURI
+	}
+
+	proxyURL, err := url.Parse(proxyURI)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy \"%s\": %s", proxyURI, err.Error())
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported upstream proxy scheme \"%s\"", proxyURL.Scheme)
+	}
+
+	return proxyURL, nil
+}
+
+// getEnv returns the environment variable in upper or lower case
+func getEnv(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		value = os.Getenv(strings.ToLower(name))
+	}
+	return value
+}
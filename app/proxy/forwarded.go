@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedHeaders describes how a proxy entry tells the upstreams about the original request
+type ForwardedHeaders struct {
+	XForwarded   bool     `json:"x-forwarded"`
+	Forwarded    bool     `json:"forwarded"`
+	PreserveHost bool     `json:"preserve-host"`
+	Trusted      []string `json:"trusted"`
+
+	networks []*net.IPNet
+}
+
+var xForwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Forwarded-Prefix"}
+
+/////////////////////////////// Forwarded Headers ///////////////////////////////
+
+func (forwarded *ForwardedHeaders) init() error {
+	if forwarded == nil {
+		return nil
+	}
+
+	for _, entry := range forwarded.Trusted {
+		if !strings.Contains(entry, "/") {
+			// Single addresses are networks containing only that address
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted network \"%s\"", entry)
+		}
+		forwarded.networks = append(forwarded.networks, network)
+	}
+	return nil
+}
+
+// trusts returns whether the forwarded headers sent by the client are kept
+func (forwarded *ForwardedHeaders) trusts(ip net.IP) bool {
+	for _, network := range forwarded.networks {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply sets the forwarded headers of the upstream request. Forwarded headers of untrusted clients are removed, the
+// ones of trusted clients are extended.
+func (forwarded *ForwardedHeaders) apply(proxy *Proxy, req *http.Request, newReq *http.Request) {
+	if forwarded == nil {
+		return
+	}
+
+	client, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		client = req.RemoteAddr
+	}
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+
+	if !forwarded.trusts(net.ParseIP(client)) {
+		newReq.Header.Del("Forwarded")
+		for _, name := range xForwardedHeaders {
+			newReq.Header.Del(name)
+		}
+	}
+
+	if forwarded.XForwarded {
+		if previous := newReq.Header.Get("X-Forwarded-For"); previous != "" {
+			newReq.Header.Set("X-Forwarded-For", previous+", "+client)
+		} else {
+			newReq.Header.Set("X-Forwarded-For", client)
+		}
+		// Values set by a trusted proxy describe the original request better than the current one
+		setDefaultHeader(newReq.Header, "X-Forwarded-Host", req.Host)
+		setDefaultHeader(newReq.Header, "X-Forwarded-Proto", proto)
+		setDefaultHeader(newReq.Header, "X-Forwarded-Prefix", strings.TrimSuffix(proxy.URLFrom, "/"))
+	}
+
+	if forwarded.Forwarded {
+		node := client
+		if strings.Contains(node, ":") {
+			node = "[" + node + "]"
+		}
+		element := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedValue(node), forwardedValue(req.Host), proto)
+		if previous := newReq.Header.Get("Forwarded"); previous != "" {
+			element = previous + ", " + element
+		}
+		newReq.Header.Set("Forwarded", element)
+	}
+
+	if forwarded.PreserveHost {
+		newReq.Host = req.Host
+	}
+}
+
+// forwardedValue quotes values of the Forwarded header that are not valid tokens, see RFC 7239
+func forwardedValue(value string) string {
+	for _, char := range value {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", char) &&
+			!(char >= '0' && char <= '9') && !(char >= 'a' && char <= 'z') && !(char >= 'A' && char <= 'Z') {
+			return "\"" + strings.ReplaceAll(value, "\"", "\\\"") + "\""
+		}
+	}
+	return value
+}
+
+// setDefaultHeader sets the header unless it already has a value
+func setDefaultHeader(header http.Header, name string, value string) {
+	if header.Get(name) == "" {
+		header.Set(name, value)
+	}
+}
@@ -23,13 +23,19 @@ func runServer(config *Configuration) {
 	// Serve web application
 	webServer := &http.Server{
 		Addr:         fmt.Sprintf(":%d", config.port),
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		ReadTimeout:  time.Duration(config.Timeouts.Read),
+		WriteTimeout: time.Duration(config.Timeouts.Write),
+		IdleTimeout:  time.Duration(config.Timeouts.Idle),
 		Handler:      webHandler,
 		// Errorlog:     logger.log.Getlogger(logger.logLevelError),
 	}
 
+	// Cleartext HTTP/2 is accepted from clients using it with prior knowledge, like most gRPC clients
+	webServer.Protocols = &http.Protocols{}
+	webServer.Protocols.SetHTTP1(true)
+	webServer.Protocols.SetHTTP2(true)
+	webServer.Protocols.SetUnencryptedHTTP2(true)
+
 	config.active = true
 
 	// Allow graceful shutdown
@@ -42,18 +48,50 @@ func runServer(config *Configuration) {
 		webServer.Shutdown(ctx)
 	}()
 
+	if config.TLS != nil {
+		keyFile := config.TLS.Key
+		if keyFile == "" {
+			// Certificate and key may be stored in the same file
+			keyFile = config.TLS.Cert
+		}
+
+		// HTTP/2 is negotiated automatically with browsers supporting it
+		logStd("Serving \"%s\" on https://localhost:%d\n", config.serverDir, config.port)
+		log.Fatalln(webServer.ListenAndServeTLS(config.TLS.Cert, keyFile))
+	}
+
 	logStd("Serving \"%s\" on http://localhost:%d\n", config.serverDir, config.port)
 	log.Fatalln(webServer.ListenAndServe())
 }
 
 func createRequesthandler(config *Configuration) func(w http.ResponseWriter, req *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
+		if config.Admin != "" && strings.Index(req.URL.Path, config.Admin) == 0 {
+			handleAdmin(config, w, req)
+			return
+		}
+
+		if config.HAR != nil {
+			capture := config.HAR.capture(w, req)
+			defer capture.finish()
+			w = capture
+		}
+
+		if len(config.Hooks) > 0 {
+			req = runHooks(config, w, req)
+			if req == nil {
+				return
+			}
+		}
+
 		uri := req.URL.RequestURI()
 		for path, proxy := range config.Proxies {
 			if strings.Index(uri, path) == 0 {
 				// Proxy path found
 				// Route through proxy
-				proxyRequest(proxy, w, req)
+				proxy.handle(w, req, func(w http.ResponseWriter) {
+					proxyRequest(proxy, w, req)
+				})
 				return
 			}
 		}
@@ -62,13 +100,17 @@ func createRequesthandler(config *Configuration) func(w http.ResponseWriter, req
 			if strings.Index(uri, path) == 0 {
 				// Proxy path found
 				// Route through proxy
-				executePlugin(config, plugin, w, req)
+				plugin.handle(w, req, func(w http.ResponseWriter) {
+					executePlugin(config, plugin, w, req)
+				})
 				return
 			}
 		}
 
 		// Handled by server
-		http.ServeFile(w, req, filepath.Join(config.serverDir, req.URL.Path[1:]))
+		config.Static.handle(w, req, func(w http.ResponseWriter) {
+			http.ServeFile(w, req, filepath.Join(config.serverDir, req.URL.Path[1:]))
+		})
 	}
 }
 
@@ -88,7 +130,11 @@ func outputRoutes(config *Configuration) {
 		}
 	}
 	for path, proxy := range config.Proxies {
-		logStd(fmt.Sprintf(" - %%-%ds => %%s\n", pathLen), path, proxy.URLTo)
+		targets := make([]string, len(proxy.Upstreams))
+		for i, upstream := range proxy.Upstreams {
+			targets[i] = upstream.URL
+		}
+		logStd(fmt.Sprintf(" - %%-%ds => %%s\n", pathLen), path, strings.Join(targets, ", "))
 	}
 	for path, plugin := range config.Plugins {
 		logStd(fmt.Sprintf(" - %%-%ds => %%s\n", pathLen), path, plugin.Executable)
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// grpcWeb translates a gRPC-Web exchange, see https://github.com/grpc/grpc/blob/master/doc/PROTOCOL-WEB.md
+type grpcWeb struct {
+	text bool
+}
+
+// grpcWebWriter encodes the response body for the browser
+type grpcWebWriter struct {
+	w    http.ResponseWriter
+	text bool
+}
+
+// flushWriter sends every write to the client immediately, which is required for streamed responses
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+/////////////////////////////// gRPC ///////////////////////////////
+
+func (proxy *Proxy) initGRPC() error {
+	switch proxy.GRPC {
+	case "":
+		return nil
+	case GRPCModeProxy, GRPCModeWeb:
+		// gRPC requires HTTP/2 with trailers, gRPC servers without TLS support h2c
+		proxy.HTTP2 = true
+		proxy.H2C = true
+
+		// Streaming calls may take any time, unless the route sets a total timeout only the response headers are
+		// limited and broken connections are detected with pings
+		if proxy.Timeouts == nil || proxy.Timeouts.Total <= 0 {
+			if proxy.timeouts.ResponseHeader <= 0 {
+				proxy.timeouts.ResponseHeader = proxy.timeouts.Total
+			}
+			proxy.timeouts.Total = 0
+		}
+		// Client streams may also take any time, the request body is only limited if the route sets a read timeout
+		if proxy.Timeouts == nil || proxy.Timeouts.Read <= 0 {
+			proxy.timeouts.Read = 0
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown gRPC mode \"%s\"", proxy.GRPC)
+	}
+}
+
+// isGRPC returns whether the content type belongs to gRPC or gRPC-Web
+func isGRPC(contentType string) bool {
+	return strings.HasPrefix(contentType, "application/grpc")
+}
+
+// translateGRPCWeb turns a gRPC-Web request into a gRPC request. For all other requests nil is returned.
+func (proxy *Proxy) translateGRPCWeb(req *http.Request) (*http.Request, *grpcWeb, error) {
+	contentType := req.Header.Get("Content-Type")
+	if proxy.GRPC != GRPCModeWeb || !strings.HasPrefix(contentType, "application/grpc-web") {
+		return nil, nil, nil
+	}
+
+	web := &grpcWeb{text: strings.HasPrefix(contentType, "application/grpc-web-text")}
+	translated := req.Clone(req.Context())
+
+	if web.text {
+		encoded, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return nil, nil, err
+		}
+		decoded, err := decodeBase64Chunks(encoded)
+		if err != nil {
+			return nil, nil, err
+		}
+		translated.Body = ioutil.NopCloser(bytes.NewReader(decoded))
+		translated.ContentLength = int64(len(decoded))
+		contentType = strings.Replace(contentType, "application/grpc-web-text", "application/grpc", 1)
+	} else {
+		contentType = strings.Replace(contentType, "application/grpc-web", "application/grpc", 1)
+	}
+
+	translated.Header.Set("Content-Type", contentType)
+	translated.Header.Set("TE", "trailers")
+	translated.Header.Del("Content-Length")
+	translated.Header.Del("X-Grpc-Web")
+	translated.Header.Del("Accept")
+
+	return translated, web, nil
+}
+
+// writeHeader adapts the gRPC response headers for the browser, the trailers are sent as part of the body
+func (web *grpcWeb) writeHeader(w http.ResponseWriter) {
+	header := w.Header()
+	header.Del("Trailer")
+	header.Del("Content-Length")
+
+	contentType := header.Get("Content-Type")
+	if web.text {
+		contentType = strings.Replace(contentType, "application/grpc", "application/grpc-web-text", 1)
+	} else {
+		contentType = strings.Replace(contentType, "application/grpc", "application/grpc-web", 1)
+	}
+	header.Set("Content-Type", contentType)
+}
+
+// writer returns the writer for the messages of the response body
+func (web *grpcWeb) writer(w http.ResponseWriter) io.Writer {
+	return &grpcWebWriter{w: w, text: web.text}
+}
+
+// writeTrailer sends the trailers of the gRPC response as the final frame of the body
+func (web *grpcWeb) writeTrailer(w http.ResponseWriter, resp *http.Response) {
+	if len(resp.Trailer) == 0 {
+		// The status of "trailers-only" responses is already part of the headers
+		return
+	}
+
+	trailer := &bytes.Buffer{}
+	for name, values := range resp.Trailer {
+		for _, value := range values {
+			fmt.Fprintf(trailer, "%s: %s\r\n", strings.ToLower(name), value)
+		}
+	}
+
+	frame := make([]byte, 5, 5+trailer.Len())
+	frame[0] = 0x80
+	binary.BigEndian.PutUint32(frame[1:], uint32(trailer.Len()))
+	frame = append(frame, trailer.Bytes()...)
+
+	web.writer(w).Write(frame)
+}
+
+func (writer *grpcWebWriter) Write(data []byte) (int, error) {
+	var err error
+	if writer.text {
+		// Each chunk is encoded on its own, gRPC-Web clients decode padded chunks separately
+		_, err = writer.w.Write([]byte(base64.StdEncoding.EncodeToString(data)))
+	} else {
+		_, err = writer.w.Write(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if flusher, ok := writer.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return len(data), nil
+}
+
+// decodeBase64Chunks decodes base64 data consisting of several padded chunks
+func decodeBase64Chunks(encoded []byte) ([]byte, error) {
+	encoded = bytes.Join(bytes.Fields(encoded), nil)
+	decoded := &bytes.Buffer{}
+	for len(encoded) > 0 {
+		size := 4
+		if len(encoded) < size {
+			size = len(encoded)
+		}
+		chunk, err := base64.StdEncoding.DecodeString(string(encoded[:size]))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gRPC-Web text body: %s", err.Error())
+		}
+		decoded.Write(chunk)
+		encoded = encoded[size:]
+	}
+	return decoded.Bytes(), nil
+}
+
+func (writer *flushWriter) Write(data []byte) (int, error) {
+	written, err := writer.w.Write(data)
+	if flusher, ok := writer.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return written, err
+}
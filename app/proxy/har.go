@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// HARLog describes the HTTP Archive file all exchanges are written to
+type HARLog struct {
+	File    string `json:"file"`
+	Bodies  bool   `json:"bodies"`
+	MaxBody int    `json:"max-body"`
+	MaxSize int64  `json:"max-size"`
+
+	mutex   sync.Mutex
+	out     *os.File
+	size    int64
+	entries int
+}
+
+// HAR 1.2 structures, see http://www.softwareishard.com/blog/har-12-spec/
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harCookie    `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// harTrailer closes the entries array and the log object, it is overwritten when a new entry is added
+const harTrailer = "\n]}}\n"
+
+/////////////////////////////// HAR File ///////////////////////////////
+
+func (har *HARLog) init() error {
+	if har == nil {
+		return nil
+	}
+	if har.File == "" {
+		return fmt.Errorf("no HAR file configured")
+	}
+	if har.MaxBody <= 0 {
+		har.MaxBody = 64 * 1024
+	}
+
+	har.mutex.Lock()
+	defer har.mutex.Unlock()
+	return har.open()
+}
+
+// open creates a new HAR file, an existing file is rotated
+func (har *HARLog) open() error {
+	_, err := os.Stat(har.File)
+	if err == nil {
+		ext := filepath.Ext(har.File)
+		base := fmt.Sprintf("%s-%s", strings.TrimSuffix(har.File, ext), time.Now().Format("20060102-150405.000"))
+		rotated := base + ext
+		// Never overwrite an earlier archive of a rotation within the same millisecond
+		for i := 1; ; i++ {
+			_, err = os.Stat(rotated)
+			if err != nil {
+				break
+			}
+			rotated = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		err = os.Rename(har.File, rotated)
+		if err != nil {
+			return err
+		}
+	}
+
+	out, err := os.Create(har.File)
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf(`{"log":{"version":"1.2","creator":{"name":"%s","version":"%s"},"entries":[`, AppName, AppVersion)
+	_, err = out.WriteString(header + harTrailer)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	har.out = out
+	har.size = int64(len(header))
+	har.entries = 0
+	return nil
+}
+
+// rotate closes the current HAR file and starts a new one
+func (har *HARLog) rotate() error {
+	har.mutex.Lock()
+	defer har.mutex.Unlock()
+
+	har.out.Close()
+	return har.open()
+}
+
+// add appends the entry in front of the trailer of the HAR file
+func (har *HARLog) add(entry *harEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		logError("HAR entry: %s\n", err.Error())
+		return
+	}
+
+	har.mutex.Lock()
+	defer har.mutex.Unlock()
+
+	if har.MaxSize > 0 && har.entries > 0 && har.size+int64(len(data)) > har.MaxSize {
+		har.out.Close()
+		err = har.open()
+		if err != nil {
+			logError("HAR rotation: %s\n", err.Error())
+			return
+		}
+	}
+
+	separator := "\n"
+	if har.entries > 0 {
+		separator = ",\n"
+	}
+
+	_, err = har.out.WriteAt([]byte(separator+string(data)+harTrailer), har.size)
+	if err != nil {
+		logError("HAR entry: %s\n", err.Error())
+		return
+	}
+
+	har.size += int64(len(separator) + len(data))
+	har.entries++
+}
+
+/////////////////////////////// HAR Capture ///////////////////////////////
+
+// harCapture records an exchange handled by the webserver
+type harCapture struct {
+	http.ResponseWriter
+	har         *HARLog
+	req         *http.Request
+	started     time.Time
+	headersSent time.Time
+	status      int
+	written     int64
+	requestBody *cappedBuffer
+	body        *cappedBuffer
+}
+
+// cappedBuffer stores written data up to a maximum size while counting all written bytes
+type cappedBuffer struct {
+	bytes.Buffer
+	max   int
+	total int64
+}
+
+func (buffer *cappedBuffer) Write(data []byte) (int, error) {
+	buffer.total += int64(len(data))
+	if remaining := buffer.max - buffer.Len(); remaining > 0 {
+		if len(data) > remaining {
+			buffer.Buffer.Write(data[:remaining])
+		} else {
+			buffer.Buffer.Write(data)
+		}
+	}
+	return len(data), nil
+}
+
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// capture wraps the response writer and request body so the exchange can be added to the HAR file
+func (har *HARLog) capture(w http.ResponseWriter, req *http.Request) *harCapture {
+	capture := &harCapture{
+		ResponseWriter: w,
+		har:            har,
+		req:            req,
+		started:        time.Now(),
+		requestBody:    &cappedBuffer{max: har.MaxBody},
+		body:           &cappedBuffer{max: har.MaxBody},
+	}
+	if !har.Bodies {
+		capture.requestBody.max = 0
+		capture.body.max = 0
+	}
+
+	if req.Body != nil {
+		req.Body = &teeReadCloser{Reader: io.TeeReader(req.Body, capture.requestBody), Closer: req.Body}
+	}
+
+	return capture
+}
+
+func (capture *harCapture) WriteHeader(status int) {
+	// Informational responses are sent before the final response
+	if capture.status == 0 && status >= 200 {
+		capture.status = status
+		capture.headersSent = time.Now()
+	}
+	capture.ResponseWriter.WriteHeader(status)
+}
+
+func (capture *harCapture) Write(data []byte) (int, error) {
+	if capture.status == 0 {
+		capture.WriteHeader(200)
+	}
+	capture.body.Write(data)
+	return capture.ResponseWriter.Write(data)
+}
+
+// Flush implements http.Flusher
+func (capture *harCapture) Flush() {
+	if flusher, ok := capture.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped response writer for http.ResponseController
+func (capture *harCapture) Unwrap() http.ResponseWriter {
+	return capture.ResponseWriter
+}
+
+// finish adds the captured exchange to the HAR file
+func (capture *harCapture) finish() {
+	finished := time.Now()
+	if capture.status == 0 {
+		capture.status = 200
+		capture.headersSent = finished
+	}
+
+	req := capture.req
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+
+	entry := &harEntry{
+		StartedDateTime: capture.started.Format(time.RFC3339Nano),
+		Time:            milliseconds(finished.Sub(capture.started)),
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         fmt.Sprintf("%s://%s%s", scheme, req.Host, req.URL.RequestURI()),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies(req.Cookies()),
+			Headers:     harHeaders(req.Header),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    capture.requestBody.total,
+		},
+		Response: harResponse{
+			Status:      capture.status,
+			StatusText:  http.StatusText(capture.status),
+			HTTPVersion: req.Proto,
+			Cookies:     harCookies((&http.Response{Header: capture.Header()}).Cookies()),
+			Headers:     harHeaders(capture.Header()),
+			Content: harContent{
+				Size:     capture.body.total,
+				MimeType: capture.Header().Get("Content-Type"),
+			},
+			RedirectURL: capture.Header().Get("Location"),
+			HeadersSize: -1,
+			BodySize:    capture.body.total,
+		},
+		Timings: harTimings{
+			Wait:    milliseconds(capture.headersSent.Sub(capture.started)),
+			Receive: milliseconds(finished.Sub(capture.headersSent)),
+		},
+	}
+
+	for name, values := range req.URL.Query() {
+		for _, value := range values {
+			entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: name, Value: value})
+		}
+	}
+
+	if capture.requestBody.total > 0 {
+		entry.Request.PostData = &harPostData{
+			MimeType: req.Header.Get("Content-Type"),
+			Text:     capture.requestBody.String(),
+		}
+	}
+
+	if capture.body.Len() > 0 {
+		if utf8.Valid(capture.body.Bytes()) {
+			entry.Response.Content.Text = capture.body.String()
+		} else {
+			entry.Response.Content.Text = base64.StdEncoding.EncodeToString(capture.body.Bytes())
+			entry.Response.Content.Encoding = "base64"
+		}
+	}
+
+	capture.har.add(entry)
+}
+
+func harHeaders(header http.Header) []harNameValue {
+	headers := make([]harNameValue, 0, len(header))
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(headers, harNameValue{Name: name, Value: value})
+		}
+	}
+	return headers
+}
+
+func harCookies(cookies []*http.Cookie) []harCookie {
+	harCookies := make([]harCookie, len(cookies))
+	for i, cookie := range cookies {
+		harCookies[i] = harCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Domain:   cookie.Domain,
+			HTTPOnly: cookie.HttpOnly,
+			Secure:   cookie.Secure,
+		}
+		if !cookie.Expires.IsZero() {
+			harCookies[i].Expires = cookie.Expires.Format(time.RFC3339)
+		}
+	}
+	return harCookies
+}
+
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Hook describes an executable run for incoming requests before they are dispatched to proxies, plugins or static
+// files. It receives the request like a CGI plugin and may modify or answer the request.
+type Hook struct {
+	Executable string   `json:"executable"`
+	Arguments  []string `json:"arguments"`
+	Paths      []string `json:"paths"`
+	MaxBody    int64    `json:"max-body"`
+	Log        bool     `json:"log"`
+
+	plugin *Plugin
+}
+
+// hookUpstreamKey is the context key of the upstream selected by a hook
+type hookUpstreamKey struct{}
+
+/////////////////////////////// Hooks ///////////////////////////////
+
+func (hook *Hook) init(config *Configuration) error {
+	if hook.Executable == "" {
+		return errors.New("executable is missing")
+	}
+	if hook.MaxBody <= 0 {
+		hook.MaxBody = 1 << 20
+	}
+
+	hook.plugin = &Plugin{
+		Type:       PluginTypeCGI,
+		Executable: hook.Executable,
+		Arguments:  hook.Arguments,
+		Log:        hook.Log,
+	}
+	hook.plugin.timeouts = config.Timeouts
+	return nil
+}
+
+// applies returns whether the hook is configured for the request path
+func (hook *Hook) applies(req *http.Request) bool {
+	if len(hook.Paths) == 0 {
+		return true
+	}
+	uri := req.URL.RequestURI()
+	for _, path := range hook.Paths {
+		if strings.Index(uri, path) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runHooks executes all hooks for the request in the configured order and returns the modified request. If a hook
+// answered the request, nil is returned.
+func runHooks(config *Configuration, w http.ResponseWriter, req *http.Request) *http.Request {
+	for _, hook := range config.Hooks {
+		if !hook.applies(req) {
+			continue
+		}
+		var err error
+		req, err = hook.run(config, w, req)
+		if err != nil {
+			logError("Hook \"%s\": %s\n", hook.Executable, err.Error())
+			w.WriteHeader(500)
+			w.Write([]byte("Hook Error: " + err.Error()))
+			return nil
+		}
+		if req == nil {
+			return nil
+		}
+	}
+	return req
+}
+
+// run executes the hook. Output with a Status header is sent as response, otherwise the headers of the output are
+// set on the request, see HookHeader*-constants for changing the path and upstream.
+func (hook *Hook) run(config *Configuration, w http.ResponseWriter, req *http.Request) (*http.Request, error) {
+	// The hook receives at most max-body bytes, larger bodies are forwarded unchanged
+	read, err := ioutil.ReadAll(io.LimitReader(req.Body, hook.MaxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(read), req.Body))
+	body := read
+	truncated := int64(len(read)) > hook.MaxBody
+	if truncated {
+		body = read[:hook.MaxBody]
+	} else {
+		req.ContentLength = int64(len(read))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(hook.plugin.timeouts.Plugin))
+	defer cancel()
+
+	cmd := pluginCommand(ctx, config, hook.plugin, req)
+	cmd.Env = appendHeaderVariables(cgiEnvironment(config, hook.plugin, req), req.Header)
+	cmd.Env = append(cmd.Env, fmt.Sprintf("REQUEST_URI=%s", req.URL.RequestURI()))
+	if truncated {
+		cmd.Env = append(cmd.Env, "BODY_TRUNCATED=1")
+	}
+	cmd.Stdin = bytes.NewReader(body)
+	errorBuffer := bytes.Buffer{}
+	cmd.Stderr = &errorBuffer
+
+	output, err := cmd.Output()
+	if hook.Log && errorBuffer.Len() > 0 {
+		fmt.Fprintf(os.Stderr, "Hook Error Output: \n |%s\n\n", strings.ReplaceAll(errorBuffer.String(), "\n", "\n |"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	status, header, output := parseCGIOutput(output, 0)
+	if status != 0 {
+		// Answered by the hook
+		for key, values := range header {
+			w.Header()[key] = values
+		}
+		w.WriteHeader(status)
+		w.Write(output)
+		return nil, nil
+	}
+
+	for key := range header {
+		value := header.Get(key)
+		switch key {
+		case HookHeaderPath:
+			target, err := url.ParseRequestURI(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid path \"%s\": %s", value, err.Error())
+			}
+			req.URL.Path = target.Path
+			req.URL.RawPath = target.RawPath
+			req.URL.RawQuery = target.RawQuery
+			req.RequestURI = target.RequestURI()
+
+		case HookHeaderUpstream:
+			upstream := &Upstream{URL: value}
+			err = upstream.init()
+			if err != nil {
+				return nil, fmt.Errorf("invalid upstream \"%s\": %s", value, err.Error())
+			}
+			if upstream.socket != "" {
+				return nil, errors.New("hooks cannot select unix socket upstreams")
+			}
+			req = req.WithContext(context.WithValue(req.Context(), hookUpstreamKey{}, upstream))
+
+		default:
+			if value == "" {
+				req.Header.Del(key)
+			} else {
+				req.Header[key] = header[key]
+			}
+		}
+	}
+	return req, nil
+}
+
+// hookUpstream returns the upstream selected by a hook for the request or nil
+func hookUpstream(req *http.Request) *Upstream {
+	upstream, _ := req.Context().Value(hookUpstreamKey{}).(*Upstream)
+	return upstream
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"strings"
+)
+
+// hopHeaders are only valid for a single connection and must not be forwarded, see RFC 7230 section 6.1
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+/////////////////////////////// Hop-by-hop Headers ///////////////////////////////
+
+// removeHopHeaders removes the hop-by-hop headers and all headers named in the Connection header
+func removeHopHeaders(header http.Header) {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// upgradeType returns the protocol requested by the Upgrade header, if the Connection header asks for an upgrade
+func upgradeType(header http.Header) string {
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(textproto.TrimString(name), "upgrade") {
+				return header.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// prepareForwardHeaders removes the hop-by-hop headers from the upstream request and adds the Via header
+func prepareForwardHeaders(req *http.Request, newReq *http.Request) {
+	trailers := false
+	for _, value := range req.Header.Values("TE") {
+		for _, coding := range strings.Split(value, ",") {
+			trailers = trailers || strings.EqualFold(textproto.TrimString(coding), "trailers")
+		}
+	}
+
+	upgrade := upgradeType(req.Header)
+	removeHopHeaders(newReq.Header)
+
+	// Protocol upgrades are requested for the upstream connection again
+	if upgrade != "" {
+		newReq.Header.Set("Connection", "Upgrade")
+		newReq.Header.Set("Upgrade", upgrade)
+	}
+
+	// Only the information that the client accepts trailers is passed on, since the connection to the upstream
+	// uses its own transfer codings
+	if trailers {
+		newReq.Header.Set("TE", "trailers")
+	}
+	if len(req.Trailer) > 0 {
+		newReq.Trailer = req.Trailer
+	}
+	addVia(newReq.Header, req.ProtoMajor, req.ProtoMinor)
+}
+
+// addVia appends this proxy to the Via header, see RFC 7230 section 5.7.1
+func addVia(header http.Header, major int, minor int) {
+	via := fmt.Sprintf("%d.%d %s", major, minor, AppName)
+	if previous := header.Get("Via"); previous != "" {
+		via = previous + ", " + via
+	}
+	header.Set("Via", via)
+}
+
+// writeResponseHeader copies the headers of the upstream response and announces its trailers, the announced trailer
+// names are returned
+func writeResponseHeader(w http.ResponseWriter, resp *http.Response) map[string]bool {
+	removeHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	announced := map[string]bool{}
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+		announced[name] = true
+	}
+	addVia(w.Header(), resp.ProtoMajor, resp.ProtoMinor)
+	return announced
+}
+
+// writeResponseTrailer sends the trailers of the upstream response after its body has been read completely
+func writeResponseTrailer(w http.ResponseWriter, resp *http.Response, announced map[string]bool) {
+	for name, values := range resp.Trailer {
+		if !announced[name] {
+			// Trailers not announced before the body must be prefixed, see http.TrailerPrefix
+			name = http.TrailerPrefix + name
+		}
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+}
+
+// forwardInformational sends informational responses of the upstream like "103 Early Hints" to the client
+func forwardInformational(w http.ResponseWriter, req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			// "100 Continue" is sent by the server itself when the request body is read
+			if code == 100 {
+				return nil
+			}
+			responseHeader := w.Header()
+			for name, values := range header {
+				for _, value := range values {
+					responseHeader.Add(name, value)
+				}
+			}
+			w.WriteHeader(code)
+
+			// The headers of informational responses are not removed by the response writer
+			for name := range header {
+				responseHeader.Del(name)
+			}
+			return nil
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
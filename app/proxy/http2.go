@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+)
+
+// protocolTransport sends requests to plain HTTP upstreams with cleartext HTTP/2 (h2c) and all others with HTTP/2
+// over TLS, falling back to HTTP/1.1 if a TLS upstream does not support it
+type protocolTransport struct {
+	secure    *http.Transport
+	cleartext *http.Transport
+}
+
+/////////////////////////////// HTTP/2 ///////////////////////////////
+
+// enableHTTP2 returns a transport asking TLS upstreams for HTTP/2. Plain HTTP upstreams are only sent cleartext
+// HTTP/2 if h2c is set, otherwise they keep using HTTP/1.1.
+func enableHTTP2(transport *http.Transport, h2c bool) http.RoundTripper {
+	transport.Protocols = &http.Protocols{}
+	transport.Protocols.SetHTTP1(true)
+	transport.Protocols.SetHTTP2(true)
+	if !h2c {
+		return transport
+	}
+
+	// Without TLS there is no protocol negotiation, so the upstream must support HTTP/2 with prior knowledge
+	cleartext := transport.Clone()
+	cleartext.Protocols = &http.Protocols{}
+	cleartext.Protocols.SetUnencryptedHTTP2(true)
+
+	return &protocolTransport{secure: transport, cleartext: cleartext}
+}
+
+func (transport *protocolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Protocol upgrades like WebSocket are only possible with HTTP/1.1
+	if req.URL.Scheme == "http" && upgradeType(req.Header) == "" {
+		return transport.cleartext.RoundTrip(req)
+	}
+	return transport.secure.RoundTrip(req)
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Mirror describes a shadow upstream that receives a copy of the requests of a proxy entry
+type Mirror struct {
+	URL           string   `json:"url"`
+	Percentage    float64  `json:"percentage"`
+	MaxBody       int64    `json:"max-body"`
+	Compare       bool     `json:"compare"`
+	IgnoreHeaders []string `json:"ignore-headers"`
+	Credentials   bool     `json:"credentials"`
+
+	upstream *Upstream
+}
+
+// mirrorExchange is a request sent to the shadow upstream
+type mirrorExchange struct {
+	mirror  *Mirror
+	method  string
+	uri     string
+	primary chan *mirrorResult
+	result  *mirrorResult
+	body    *cappedBuffer
+}
+
+// mirrorResult is the part of a response that is compared, truncated bodies exceeded max-body
+type mirrorResult struct {
+	status    int
+	header    http.Header
+	body      []byte
+	truncated bool
+}
+
+// maxMirrorDifferences limits the number of logged body differences of an exchange
+const maxMirrorDifferences = 20
+
+/////////////////////////////// Mirroring ///////////////////////////////
+
+func (mirror *Mirror) init() error {
+	if mirror == nil {
+		return nil
+	}
+	if mirror.Percentage <= 0 {
+		mirror.Percentage = 100
+	}
+	if mirror.MaxBody <= 0 {
+		mirror.MaxBody = 1024 * 1024
+	}
+	mirror.IgnoreHeaders = append(mirror.IgnoreHeaders, "Date")
+
+	mirror.upstream = &Upstream{URL: mirror.URL}
+	return mirror.upstream.init()
+}
+
+// targets returns the upstreams and the shadow upstream of the proxy entry
+func (proxy *Proxy) targets() []*Upstream {
+	if proxy.Mirror == nil {
+		return proxy.Upstreams
+	}
+	return append(append([]*Upstream{}, proxy.Upstreams...), proxy.Mirror.upstream)
+}
+
+// credentialTargets returns the upstreams receiving the credentials of the proxy entry, the shadow upstream only if
+// this is configured explicitly
+func (proxy *Proxy) credentialTargets() []*Upstream {
+	if proxy.Mirror == nil || !proxy.Mirror.Credentials {
+		return proxy.Upstreams
+	}
+	return proxy.targets()
+}
+
+// start sends a copy of the request to the shadow upstream in the background. Requests whose body was not buffered
+// are not mirrored.
+func (mirror *Mirror) start(proxy *Proxy, req *http.Request, body []byte, buffered bool) *mirrorExchange {
+	if mirror == nil || !buffered || !chance(mirror.Percentage) {
+		return nil
+	}
+
+	newReq, _, err := createProxyRequest(proxy, mirror.upstream, req, bytes.NewReader(body))
+	if err != nil {
+		logError("Mirror: %s\n", err.Error())
+		return nil
+	}
+
+	exchange := &mirrorExchange{
+		mirror:  mirror,
+		method:  req.Method,
+		uri:     req.URL.RequestURI(),
+		primary: make(chan *mirrorResult, 1),
+	}
+	go exchange.send(proxy, newReq)
+	return exchange
+}
+
+func (exchange *mirrorExchange) send(proxy *Proxy, newReq *http.Request) {
+	// The shadow upstream has its own session, the client cookies are part of the request
+	client := &http.Client{
+		Transport: proxy.client.Transport,
+		Timeout:   time.Duration(proxy.timeouts.Total),
+	}
+
+	resp, err := client.Do(newReq)
+	if err != nil {
+		logError("Mirror %s %s: %s\n", exchange.method, exchange.uri, err.Error())
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, exchange.mirror.MaxBody+1))
+	resp.Body.Close()
+	if err != nil {
+		logError("Mirror %s %s: %s\n", exchange.method, exchange.uri, err.Error())
+		return
+	}
+	truncated := int64(len(body)) > exchange.mirror.MaxBody
+	if truncated {
+		body = body[:exchange.mirror.MaxBody]
+	}
+	logDebug("Mirror %s %s => %d\n", exchange.method, exchange.uri, resp.StatusCode)
+
+	if !exchange.mirror.Compare {
+		return
+	}
+	primary := <-exchange.primary
+	if primary == nil {
+		return
+	}
+
+	removeHopHeaders(resp.Header)
+	shadow := &mirrorResult{status: resp.StatusCode, header: resp.Header, body: body, truncated: truncated}
+	differences := exchange.mirror.differences(primary, shadow)
+	if len(differences) > 0 {
+		logStd("Mirror differences for %s %s (primary != shadow):\n  %s\n", exchange.method, exchange.uri,
+			strings.Join(differences, "\n  "))
+	}
+}
+
+// capture keeps the upstream response as it was received, before it is filtered or transformed. The body is
+// captured up to max-body while it is read.
+func (exchange *mirrorExchange) capture(resp *http.Response) {
+	if exchange == nil || !exchange.mirror.Compare {
+		return
+	}
+	exchange.result = &mirrorResult{status: resp.StatusCode, header: resp.Header.Clone()}
+	removeHopHeaders(exchange.result.header)
+	exchange.body = &cappedBuffer{max: int(exchange.mirror.MaxBody)}
+	resp.Body = &teeReadCloser{Reader: io.TeeReader(resp.Body, exchange.body), Closer: resp.Body}
+}
+
+// compare hands the captured primary response to the comparison with the shadow response
+func (exchange *mirrorExchange) compare() {
+	if exchange == nil || exchange.result == nil {
+		return
+	}
+	exchange.result.body = exchange.body.Bytes()
+	exchange.result.truncated = exchange.body.total > int64(exchange.body.max)
+	select {
+	case exchange.primary <- exchange.result:
+	default:
+	}
+}
+
+// finish ends the exchange if the primary response was not available for comparison
+func (exchange *mirrorExchange) finish() {
+	if exchange == nil {
+		return
+	}
+	select {
+	case exchange.primary <- nil:
+	default:
+	}
+}
+
+// differences lists the differences of status, headers and body of the responses
+func (mirror *Mirror) differences(primary *mirrorResult, shadow *mirrorResult) []string {
+	differences := []string{}
+	if primary.status != shadow.status {
+		differences = append(differences, fmt.Sprintf("status: %d != %d", primary.status, shadow.status))
+	}
+
+	names := map[string]bool{}
+	for name := range primary.header {
+		names[name] = true
+	}
+	for name := range shadow.header {
+		names[name] = true
+	}
+	sorted := []string{}
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		if mirror.ignoresHeader(name) {
+			continue
+		}
+		primaryValue := strings.Join(primary.header.Values(name), ", ")
+		shadowValue := strings.Join(shadow.header.Values(name), ", ")
+		if primaryValue != shadowValue {
+			differences = append(differences, fmt.Sprintf("header %s: %q != %q", name, primaryValue, shadowValue))
+		}
+	}
+
+	if primary.truncated || shadow.truncated {
+		logDebug("Mirror: bodies larger than max-body are not compared\n")
+		return differences
+	}
+
+	primaryBody := decodedBody(primary)
+	shadowBody := decodedBody(shadow)
+	var primaryJSON, shadowJSON interface{}
+	if json.Unmarshal(primaryBody, &primaryJSON) == nil && json.Unmarshal(shadowBody, &shadowJSON) == nil {
+		bodyDifferences := diffJSON("$", primaryJSON, shadowJSON, nil)
+		if len(bodyDifferences) > maxMirrorDifferences {
+			more := len(bodyDifferences) - maxMirrorDifferences
+			bodyDifferences = append(bodyDifferences[:maxMirrorDifferences], fmt.Sprintf("... %d more", more))
+		}
+		differences = append(differences, bodyDifferences...)
+	} else if !bytes.Equal(primaryBody, shadowBody) {
+		differences = append(differences, fmt.Sprintf("body: %d bytes != %d bytes", len(primaryBody), len(shadowBody)))
+	}
+
+	return differences
+}
+
+func (mirror *Mirror) ignoresHeader(name string) bool {
+	for _, ignored := range mirror.IgnoreHeaders {
+		if strings.EqualFold(ignored, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodedBody returns the body of the response without gzip encoding
+func decodedBody(result *mirrorResult) []byte {
+	if result.header.Get("Content-Encoding") != "gzip" {
+		return result.body
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(result.body))
+	if err != nil {
+		return result.body
+	}
+	decoded, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return result.body
+	}
+	return decoded
+}
+
+// diffJSON appends the paths of all differing values of the JSON documents to differences
+func diffJSON(path string, primary interface{}, shadow interface{}, differences []string) []string {
+	primaryObject, primaryIsObject := primary.(map[string]interface{})
+	shadowObject, shadowIsObject := shadow.(map[string]interface{})
+	if primaryIsObject && shadowIsObject {
+		names := map[string]bool{}
+		for name := range primaryObject {
+			names[name] = true
+		}
+		for name := range shadowObject {
+			names[name] = true
+		}
+		sorted := []string{}
+		for name := range names {
+			sorted = append(sorted, name)
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			differences = diffJSON(path+"."+name, primaryObject[name], shadowObject[name], differences)
+		}
+		return differences
+	}
+
+	primaryArray, primaryIsArray := primary.([]interface{})
+	shadowArray, shadowIsArray := shadow.([]interface{})
+	if primaryIsArray && shadowIsArray && len(primaryArray) == len(shadowArray) {
+		for i := range primaryArray {
+			differences = diffJSON(fmt.Sprintf("%s[%d]", path, i), primaryArray[i], shadowArray[i], differences)
+		}
+		return differences
+	}
+
+	if !reflect.DeepEqual(primary, shadow) {
+		primaryValue, _ := json.Marshal(primary)
+		shadowValue, _ := json.Marshal(shadow)
+		differences = append(differences, fmt.Sprintf("body %s: %s != %s", path, primaryValue, shadowValue))
+	}
+	return differences
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"net/http"
+)
+
+// MockResponse describes a fixed response that is sent instead of contacting an upstream
+type MockResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+// write sends the mock response to the client
+func (mock *MockResponse) write(w http.ResponseWriter) {
+	for key, value := range mock.Headers {
+		w.Header().Set(key, value)
+	}
+
+	status := mock.Status
+	if status == 0 {
+		status = 200
+	}
+
+	w.WriteHeader(status)
+	w.Write([]byte(mock.Body))
+}
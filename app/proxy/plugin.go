@@ -24,6 +24,7 @@ type Plugin struct {
 	ContentType string     `json:"content-type"`
 	Log         bool       `json:"log"`
 	URLFrom     string     `json:"-"`
+	RouteOptions
 }
 
 func executePlugin(config *Configuration, plugin *Plugin, w http.ResponseWriter, req *http.Request) {
@@ -43,6 +44,39 @@ func executePlugin(config *Configuration, plugin *Plugin, w http.ResponseWriter,
 }
 
 func executePluginCGI(config *Configuration, plugin *Plugin, w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(plugin.timeouts.Plugin))
+	defer cancel()
+
+	cmd := pluginCommand(ctx, config, plugin, req)
+	cmd.Env = cgiEnvironment(config, plugin, req)
+
+	errorBuffer := bytes.Buffer{}
+	cmd.Stderr = &errorBuffer
+	cmd.Stdin = req.Body
+	output, err := cmd.Output()
+
+	if plugin.Log && errorBuffer.Len() > 0 {
+		fmt.Fprintf(os.Stderr, "CGI Error Output: \n |%s\n\n", strings.ReplaceAll(errorBuffer.String(), "\n", "\n |"))
+	}
+
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(500)
+		w.Write([]byte(fmt.Sprintf("CGI invocation error: %s\n", err.Error())))
+	} else {
+		status, header, body := parseCGIOutput(output, 200)
+		for key, values := range header {
+			for _, value := range values {
+				w.Header().Add(key, value)
+			}
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	}
+}
+
+// cgiEnvironment creates the CGI meta-variables for the request
+func cgiEnvironment(config *Configuration, plugin *Plugin, req *http.Request) []string {
 	// TODO: Should we add real environment variables?
 	// env := os.Environ()
 	env := make([]string, 0, 21) // 21 - maximum filled
@@ -103,85 +137,91 @@ func executePluginCGI(config *Configuration, plugin *Plugin, w http.ResponseWrit
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-
-	executable := replacePluginMacrosSingle(plugin.Executable, plugin, req, config)
-	args := replacePluginMacros(plugin.Arguments, plugin, req, config)
-
-	cmd := exec.CommandContext(ctx, executable, args...)
-	cmd.Env = env
-
-	errorBuffer := bytes.Buffer{}
-	cmd.Stderr = &errorBuffer
-	cmd.Stdin = req.Body
-	output, err := cmd.Output()
+	return env
+}
 
-	if plugin.Log && errorBuffer.Len() > 0 {
-		fmt.Fprintf(os.Stderr, "CGI Error Output: \n |%s\n\n", strings.ReplaceAll(errorBuffer.String(), "\n", "\n |"))
+// appendHeaderVariables adds the headers as HTTP_* variables unless the environment already contains them
+func appendHeaderVariables(env []string, header http.Header) []string {
+	existing := make(map[string]bool, len(env))
+	for _, variable := range env {
+		existing[strings.SplitN(variable, "=", 2)[0]] = true
+	}
+	for key, values := range header {
+		if key == "Content-Length" || key == "Content-Type" {
+			continue
+		}
+		name := "HTTP_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if !existing[name] {
+			env = append(env, fmt.Sprintf("%s=%s", name, strings.Join(values, ", ")))
+		}
 	}
+	return env
+}
 
-	if err != nil {
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(500)
-		w.Write([]byte(fmt.Sprintf("CGI invocation error: %s\n", err.Error())))
-	} else {
-		lines := bytes.Split(output, []byte("\n"))
-		header := true
-		headerWritten := false
-		status := 200
-
-		for _, line := range lines {
-			validHeaderLine := bytes.Index(line, []byte(":")) > -1
-
-			if header {
-				if len(line) == 0 {
-					header = false
-					continue
-				}
-
-				if !validHeaderLine {
-					logError("Invalid Header Line: %s\n", line)
-				}
-
-				lineParts := bytes.SplitN(line, []byte(":"), 2)
-				key := strings.TrimSpace(string(lineParts[0]))
-				value := strings.TrimSpace(string(lineParts[1]))
-
-				if strings.ToLower(key) == "status" {
-					parts := strings.SplitN(value, " ", 2)
-					status64, err := strconv.ParseInt(parts[0], 10, 0)
-					if err != nil {
-						logError("Could not parse status header from CGI: %s - \n%#v\n", err.Error(), parts)
-					} else {
-						status = int(status64)
-					}
-				} else {
-					w.Header().Add(key, value)
-				}
+// parseCGIOutput splits the output of a CGI program into status, headers and body, status is used unless the
+// output contains a Status header. The body is returned byte for byte, a line that is not a header ends the header
+// block and belongs to the body.
+func parseCGIOutput(output []byte, status int) (int, http.Header, []byte) {
+	header := http.Header{}
+
+	for len(output) > 0 {
+		rest := output
+		var line []byte
+		end := bytes.IndexByte(output, '\n')
+		if end > -1 {
+			line = output[:end]
+			output = output[end+1:]
+		} else {
+			line = output
+			output = nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if len(line) == 0 {
+			// End of header
+			break
+		}
 
+		lineParts := bytes.SplitN(line, []byte(":"), 2)
+		if len(lineParts) != 2 {
+			// Output without header block, everything from this line on is the body
+			logError("Invalid Header Line: %s\n", line)
+			return status, header, rest
+		}
+		key := strings.TrimSpace(string(lineParts[0]))
+		value := strings.TrimSpace(string(lineParts[1]))
+
+		if strings.ToLower(key) == "status" {
+			parts := strings.SplitN(value, " ", 2)
+			status64, err := strconv.ParseInt(parts[0], 10, 0)
+			if err != nil {
+				logError("Could not parse status header from CGI: %s - \n%#v\n", err.Error(), parts)
 			} else {
-				if !headerWritten {
-					w.WriteHeader(status)
-					headerWritten = true
-				}
-				w.Write(line)
-				w.Write([]byte("\n"))
+				status = int(status64)
 			}
+		} else {
+			header.Add(key, value)
 		}
 	}
+
+	return status, header, output
+}
+
+// pluginCommand creates the command executing the plugin with all macros replaced
+func pluginCommand(ctx context.Context, config *Configuration, plugin *Plugin, req *http.Request) *exec.Cmd {
+	executable := replacePluginMacrosSingle(plugin.Executable, plugin, req, config)
+	args := replacePluginMacros(plugin.Arguments, plugin, req, config)
+
+	return exec.CommandContext(ctx, executable, args...)
 }
 
 func executePluginSimple(config *Configuration, plugin *Plugin, w http.ResponseWriter, req *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(plugin.timeouts.Plugin))
 	defer cancel()
 
 	outputBuffer := bytes.Buffer{}
 
-	executable := replacePluginMacrosSingle(plugin.Executable, plugin, req, config)
-	args := replacePluginMacros(plugin.Arguments, plugin, req, config)
-
-	cmd := exec.CommandContext(ctx, executable, args...)
+	cmd := pluginCommand(ctx, config, plugin, req)
 	cmd.Stdout = &outputBuffer
 
 	// TODO: Change content type in case of error?
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestParseCGIOutput(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		status int
+		header http.Header
+		body   string
+	}{
+		{"headers and body", "Content-Type: text/plain\n\nline 1\nline 2\n", 200,
+			http.Header{"Content-Type": {"text/plain"}}, "line 1\nline 2\n"},
+		{"body without trailing newline", "Content-Type: text/plain\n\nbody", 200,
+			http.Header{"Content-Type": {"text/plain"}}, "body"},
+		{"crlf", "Status: 404 Not Found\r\nX-A: 1\r\n\r\nmissing\r\n", 404,
+			http.Header{"X-A": {"1"}}, "missing\r\n"},
+		{"repeated headers", "Set-Cookie: a=1\nSet-Cookie: b=2\n\n", 200,
+			http.Header{"Set-Cookie": {"a=1", "b=2"}}, ""},
+		{"headers only", "Status: 204\n", 204, http.Header{}, ""},
+		{"no header block", "just text\nmore text\n", 200, http.Header{}, "just text\nmore text\n"},
+		{"header block ended by text", "X-A: 1\nplain\n", 200, http.Header{"X-A": {"1"}}, "plain\n"},
+		{"invalid status", "Status: abc\n\nbody", 200, http.Header{}, "body"},
+		{"empty", "", 200, http.Header{}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			status, header, body := parseCGIOutput([]byte(test.output), 200)
+			if status != test.status {
+				t.Errorf("status = %d, want %d", status, test.status)
+			}
+			if !reflect.DeepEqual(header, test.header) {
+				t.Errorf("header = %v, want %v", header, test.header)
+			}
+			if string(body) != test.body {
+				t.Errorf("body = %q, want %q", body, test.body)
+			}
+		})
+	}
+}
+
+func TestParseCGIOutputDefaultStatus(t *testing.T) {
+	status, _, _ := parseCGIOutput([]byte("X-A: 1\n\n"), 0)
+	if status != 0 {
+		t.Errorf("status = %d, want the default 0", status)
+	}
+}
@@ -1,32 +1,266 @@
 package main
 
 import (
-	"crypto/tls"
+	"bytes"
 	"io"
+	"io/ioutil"
 	"log"
-	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
 // Proxy describes a proxy entry in the server
 type Proxy struct {
-	URLTo      string            `json:"url"`
-	Parameters map[string]string `json:"parameters"`
-	Auth       string            `json:"auth"`
-	Log        bool              `json:"log"`
-	Insecure   bool              `json:"insecure"`
-	URLFrom    string            `json:"-"`
-	client     *http.Client
+	URLTo          string            `json:"url"`
+	Upstreams      []*Upstream       `json:"upstreams"`
+	Balance        string            `json:"balance"`
+	HealthCheck    *HealthCheck      `json:"health-check"`
+	MaxFails       int               `json:"max-fails"`
+	FailTimeout    Duration          `json:"fail-timeout"`
+	StickyCookie   string            `json:"sticky-cookie"`
+	Retry          *RetryPolicy      `json:"retry"`
+	CircuitBreaker *CircuitBreaker   `json:"circuit-breaker"`
+	Fallback       *Fallback         `json:"fallback"`
+	Mirror         *Mirror           `json:"mirror"`
+	Filter         *ResponseFilter   `json:"filter"`
+	Record         *Recorder         `json:"record"`
+	Cache          *ResponseCache    `json:"cache"`
+	CSRF           *CSRFHandling     `json:"csrf"`
+	Parameters     map[string]string `json:"parameters"`
+	Auth           *UpstreamAuth     `json:"auth"`
+	Log            bool              `json:"log"`
+	Insecure       bool              `json:"insecure"`
+	TLS            *UpstreamTLS      `json:"tls"`
+	HTTP2          bool              `json:"http2"`
+	H2C            bool              `json:"h2c"`
+	GRPC           string            `json:"grpc"`
+	Forwarded      *ForwardedHeaders `json:"forwarded"`
+	UpstreamProxy  string            `json:"upstream-proxy"`
+	NoProxy        string            `json:"no-proxy"`
+	URLFrom        string            `json:"-"`
+	client         *http.Client
+	RouteOptions
+
+	balanceCounter uint64
+	balanceMutex   sync.Mutex
 }
 
 /////////////////////////////// Proxy Client ///////////////////////////////
 
 func proxyRequest(proxy *Proxy, w http.ResponseWriter, req *http.Request) {
+	var recordFile string
+
+	translated, web, err := proxy.translateGRPCWeb(req)
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte("Proxy Error: " + err.Error()))
+		return
+	}
+	if translated != nil {
+		req = translated
+	}
+
+	if upgradeType(req.Header) != "" {
+		proxy.upgrade(w, req)
+		return
+	}
+	proxy.Filter.prepare(req)
+
+	if proxy.Record != nil {
+		recordFile, err = proxy.Record.prepare(proxy, req)
+		if err != nil {
+			w.WriteHeader(503)
+			w.Write([]byte("Proxy Error: " + err.Error()))
+			return
+		}
+
+		if proxy.Record.replaying() && proxy.Record.replay(recordFile, w) {
+			return
+		}
+		if !proxy.Record.recording() {
+			w.WriteHeader(404)
+			w.Write([]byte("Proxy Error: no recording found for " + req.URL.String()))
+			return
+		}
+	}
+
+	cacheKey := proxy.Cache.key(proxy, req)
+	cached := proxy.Cache.lookup(cacheKey)
+	if cached != nil && cached.fresh() {
+		cached.write(w, "HIT")
+		return
+	}
+
+	body, buffered, err := proxy.bufferBody(req)
+	if err != nil {
+		w.WriteHeader(503)
+		w.Write([]byte("Proxy Error: " + err.Error()))
+		return
+	}
+
+	shadow := proxy.Mirror.start(proxy, req, body, buffered)
+	defer shadow.finish()
+
+	var upstream *Upstream
+	var target *url.URL
+	var resp *http.Response
+
+	for attempt := 1; ; attempt++ {
+		var newReq *http.Request
+
+		upstream = proxy.selectUpstream(req)
+		if buffered {
+			newReq, target, err = createProxyRequest(proxy, upstream, req, bytes.NewReader(body))
+		} else {
+			newReq, target, err = createProxyRequest(proxy, upstream, req, req.Body)
+		}
+		if err != nil {
+			w.WriteHeader(503)
+			w.Write([]byte("Proxy Error: " + err.Error()))
+			return
+		}
+		if cached != nil {
+			cached.addConditions(newReq)
+		}
+		newReq = forwardInformational(w, newReq)
+
+		resp, err = proxy.send(upstream, newReq)
+
+		if !buffered || !proxy.Retry.shouldRetry(attempt, req.Method, resp, err) {
+			break
+		}
+		if resp != nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		delay := proxy.Retry.backoff(attempt)
+		logDebug("Retrying %s %s in %s (attempt %d)\n", newReq.Method, newReq.URL.String(), delay, attempt+1)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+	}
+
+	if cached != nil {
+		if err == nil && resp.StatusCode == 304 {
+			resp.Body.Close()
+			proxy.Cache.refresh(cached, resp)
+			cached.write(w, "REVALIDATED")
+			return
+		}
+		if (err != nil || resp.StatusCode >= 500) && cached.staleUsable(proxy.Cache) {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			logDebug("Serving stale cache entry for %s\n", req.URL.String())
+			cached.write(w, "STALE")
+			return
+		}
+	}
+
+	if err == errCircuitOpen && proxy.CircuitBreaker.Fallback != nil {
+		proxy.CircuitBreaker.Fallback.write(w)
+		return
+	}
+	if proxy.Fallback.applies(resp, err) {
+		if err != nil {
+			logDebug("Upstream for %s unavailable, trying fallback: %s\n", req.URL.String(), err.Error())
+		}
+		fallbackBody := body
+		if !buffered {
+			fallbackBody = nil
+		}
+		if proxy.Fallback.serve(proxy, w, req, recordFile, fallbackBody) {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return
+		}
+	}
+	if err != nil {
+		w.WriteHeader(503)
+		w.Write([]byte("Proxy Error: " + err.Error()))
+		return
+	}
+	defer resp.Body.Close()
+
+	shadow.capture(resp)
+	if proxy.Filter != nil {
+		resp, err = proxy.Filter.apply(req, resp)
+		if err != nil {
+			logError("Filter \"%s\": %s\n", proxy.Filter.Executable, err.Error())
+			w.WriteHeader(502)
+			w.Write([]byte("Filter Error: " + err.Error()))
+			return
+		}
+		defer resp.Body.Close()
+	}
+
+	// if resp.StatusCode >= 400 {
+	// 	log.Printf("HTTP Err: %s:\n %#v\n\n", newReq.URL.String(), resp.Header)
+	// }
+
+	announced := writeResponseHeader(w, resp)
+	if web != nil {
+		web.writeHeader(w)
+	}
+
+	cookies := proxy.client.Jar.Cookies(target)
+	for _, cookie := range cookies {
+		cookie.Secure = false
+		cookie.Domain = ""
+		http.SetCookie(w, cookie)
+	}
+	proxy.setStickyCookie(w, req, upstream)
+
+	if cacheKey != "" {
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	storable := proxy.Cache.storable(cacheKey, resp)
+	var responseBody io.Reader = resp.Body
+	responseBuffer := &bytes.Buffer{}
+	if proxy.Record.recording() || storable {
+		responseBody = io.TeeReader(resp.Body, responseBuffer)
+	}
+
+	var destination io.Writer = w
+	if web != nil {
+		destination = web.writer(w)
+	} else if proxy.GRPC != "" {
+		destination = &flushWriter{w: w}
+	}
+
+	w.WriteHeader(resp.StatusCode)
+	written, err := io.Copy(destination, responseBody)
+	if err != nil {
+		logError("Proxy: %d of %d - %s", written, resp.ContentLength, err.Error())
+		return
+	}
+	if web != nil {
+		web.writeTrailer(w, resp)
+	} else {
+		writeResponseTrailer(w, resp, announced)
+	}
+
+	if proxy.Record.recording() {
+		proxy.Record.record(recordFile, proxy, req, resp, responseBuffer.Bytes())
+	}
+	if storable {
+		proxy.Cache.store(proxy.Cache.storeKey(proxy, req, resp), resp, responseBuffer.Bytes())
+	}
+	shadow.compare()
+}
+
+// createProxyRequest creates the request sent to the given upstream from the incoming request
+func createProxyRequest(proxy *Proxy, upstream *Upstream, req *http.Request, body io.Reader) (*http.Request, *url.URL, error) {
 	method := req.Method
 
 	// If req.URL.Path contains escaped characters they will be replaced and we get the wrong path
@@ -36,7 +270,7 @@ func proxyRequest(proxy *Proxy, w http.ResponseWriter, req *http.Request) {
 		path = req.URL.RawPath
 	}
 
-	targetURL := strings.Replace(path, proxy.URLFrom, proxy.URLTo, 1)
+	targetURL := strings.Replace(path, proxy.URLFrom, upstream.address, 1)
 
 	target, err := url.Parse(targetURL)
 	if err != nil {
@@ -44,11 +278,12 @@ func proxyRequest(proxy *Proxy, w http.ResponseWriter, req *http.Request) {
 		os.Exit(1)
 	}
 
-	newReq, err := http.NewRequest(method, target.String(), req.Body)
+	newReq, err := http.NewRequest(method, target.String(), body)
 	if err != nil {
-		w.WriteHeader(503)
-		w.Write([]byte("Proxy Error: " + err.Error()))
-		return
+		return nil, nil, err
+	}
+	if body == req.Body {
+		newReq.ContentLength = req.ContentLength
 	}
 
 	// Make sure forced parameters are added
@@ -60,15 +295,6 @@ func proxyRequest(proxy *Proxy, w http.ResponseWriter, req *http.Request) {
 
 	logDebug("Proxying: %s => %s...\n", req.URL.Path, newReq.URL.String())
 
-	if proxy.Auth != "" {
-		if strings.Index(proxy.Auth, ":") > -1 {
-			auth := strings.SplitN(proxy.Auth, ":", 2)
-			newReq.SetBasicAuth(auth[0], auth[1])
-		} else {
-			newReq.Header.Set("Authorization", "Basic "+proxy.Auth)
-		}
-	}
-
 	newReq.URL.Scheme = target.Scheme
 	newReq.URL.Host = target.Host
 
@@ -95,6 +321,13 @@ func proxyRequest(proxy *Proxy, w http.ResponseWriter, req *http.Request) {
 		newReq.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:80.0) Gecko/20100101 Firefox/80.0")
 	}
 
+	prepareForwardHeaders(req, newReq)
+	if upstream.socket != "" {
+		// The host name standing in for the socket means nothing to the upstream
+		newReq.Host = "localhost"
+	}
+	proxy.Forwarded.apply(proxy, req, newReq)
+
 	// Replace security specific cookie parts
 	cookies := req.Cookies()
 
@@ -108,80 +341,98 @@ func proxyRequest(proxy *Proxy, w http.ResponseWriter, req *http.Request) {
 		cookieNames = append(cookieNames, cookie.Name)
 	}
 
-	// Make sure caching is disabled
-	newReq.Header.Set("Cache-Control", "no-store")
+	// Make sure caching is disabled, unless the proxy caches itself
+	if proxy.Cache == nil {
+		newReq.Header.Set("Cache-Control", "no-store")
+	}
+
+	return newReq, target, nil
+}
 
+// send executes the request against the upstream and reports the result to the load balancer
+func (proxy *Proxy) send(upstream *Upstream, newReq *http.Request) (*http.Response, error) {
 	if proxy.Log {
 		log.Printf("%s %s\n", newReq.Method, newReq.URL.String())
 	}
 
-	resp, err := proxy.client.Do(newReq)
+	if !proxy.CircuitBreaker.allow() {
+		return nil, errCircuitOpen
+	}
 
+	release := upstream.acquire()
+
+	resp, err := proxy.CSRF.do(proxy, upstream, newReq)
 	if err != nil {
-		w.WriteHeader(503)
-		w.Write([]byte("Proxy Error: " + err.Error()))
-		return
+		release()
+		upstream.reportFailure(proxy)
+		proxy.CircuitBreaker.record(true)
+		return nil, err
 	}
 
-	// if resp.StatusCode >= 400 {
-	// 	log.Printf("HTTP Err: %s:\n %#v\n\n", newReq.URL.String(), resp.Header)
-	// }
+	upstream.reportSuccess()
+	proxy.CircuitBreaker.record(resp.StatusCode >= 500)
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
 
-	for name, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(name, value)
-		}
+func createClient(config *Configuration, proxy *Proxy) (*http.Client, error) {
+	upstreamProxy := proxy.UpstreamProxy
+	if upstreamProxy == "" {
+		upstreamProxy = config.UpstreamProxy
+	}
+	noProxy := proxy.NoProxy
+	if noProxy == "" {
+		noProxy = config.NoProxy
 	}
 
-	cookies = proxy.client.Jar.Cookies(target)
-	for _, cookie := range cookies {
-		cookie.Secure = false
-		cookie.Domain = ""
-		http.SetCookie(w, cookie)
+	proxyFunc, err := createProxyFunc(upstreamProxy, noProxy)
+	if err != nil {
+		return nil, err
 	}
 
-	w.WriteHeader(resp.StatusCode)
-	written, err := io.Copy(w, resp.Body)
+	tlsConfig, err := createTLSConfig(proxy.TLS, proxy.Insecure)
 	if err != nil {
-		logError("Proxy: %d of %d - %s", written, resp.ContentLength, err.Error())
+		return nil, err
+	}
+
+	baseTransport := &http.Transport{
+		Proxy:                 proxyFunc,
+		TLSClientConfig:       tlsConfig,
+		DialContext:           createDialer(proxy),
+		IdleConnTimeout:       30 * time.Second,
+		TLSHandshakeTimeout:   time.Duration(proxy.timeouts.TLSHandshake),
+		ResponseHeaderTimeout: time.Duration(proxy.timeouts.ResponseHeader),
+	}
+
+	if proxy.GRPC != "" {
+		baseTransport.HTTP2 = &http.HTTP2Config{
+			SendPingTimeout: 30 * time.Second,
+			PingTimeout:     15 * time.Second,
+		}
+	}
+
+	var transport http.RoundTripper = baseTransport
+	if proxy.HTTP2 || proxy.H2C {
+		transport = enableHTTP2(baseTransport, proxy.H2C)
+	}
+
+	if proxy.Auth != nil {
+		err = proxy.Auth.init(config, proxy)
+		if err != nil {
+			return nil, err
+		}
+
+		hosts := map[string]bool{}
+		for _, upstream := range proxy.credentialTargets() {
+			hosts[upstream.target.Host] = true
+		}
+		transport = &authTransport{base: transport, auth: proxy.Auth, hosts: hosts}
 	}
-	defer resp.Body.Close()
-}
 
-func createClient(insecure bool) *http.Client {
 	jar, _ := cookiejar.New(nil)
 	return &http.Client{
-		Jar:     jar,
-		Timeout: 60 * time.Second,
-		Transport: &http.Transport{
-			// Proxy: http.ProxyURL(proxyURL),
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: insecure,
-			},
-			Dial: (&net.Dialer{
-				Timeout: 10 * time.Second,
-			}).Dial,
-			IdleConnTimeout:     30 * time.Second,
-			TLSHandshakeTimeout: 10 * time.Second,
-		},
-	}
+		Jar:       jar,
+		Timeout:   time.Duration(proxy.timeouts.Total),
+		Transport: transport,
+	}, nil
 }
-
-// func createProxyClient(proxyURI string) *http.Client {
-// 	// os.Setenv("HTTP_PROXY", proxyURI)
-// 	proxyURL, err := url.Parse(proxyURI)
-// 	if err != nil {
-// 		log.Println(err.Error())
-// 		os.Exit(1)
-// 	}
-
-// 	return &http.Client{
-// 		Transport: &http.Transport{
-// 			Proxy: http.ProxyURL(proxyURL),
-// 			TLSClientConfig: &tls.Config{
-// 				InsecureSkipVerify: true,
-// 			},
-// 			IdleConnTimeout: 30 * time.Second,
-// 		},
-// 	}
-// }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// RecordModeRecord stores all proxied exchanges
+	RecordModeRecord = "record"
+	// RecordModeReplay serves stored exchanges without contacting the upstream
+	RecordModeReplay = "replay"
+	// RecordModeReplayOrRecord serves stored exchanges and records the missing ones
+	RecordModeReplayOrRecord = "replay-or-record"
+)
+
+// Recorder describes how proxied requests are recorded to and replayed from a directory
+type Recorder struct {
+	Mode      string   `json:"mode"`
+	Directory string   `json:"directory"`
+	Match     []string `json:"match"`
+	Headers   []string `json:"headers"`
+}
+
+// recordedExchange is the content of a recording file
+type recordedExchange struct {
+	Method       string      `json:"method"`
+	Path         string      `json:"path"`
+	Query        string      `json:"query"`
+	Status       int         `json:"status"`
+	Header       http.Header `json:"header"`
+	Body         string      `json:"body"`
+	BodyEncoding string      `json:"body-encoding,omitempty"`
+}
+
+var recordNameCleaner = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+/////////////////////////////// Record & Replay ///////////////////////////////
+
+func (recorder *Recorder) init() error {
+	if recorder == nil {
+		return nil
+	}
+
+	switch recorder.Mode {
+	case RecordModeRecord, RecordModeReplay, RecordModeReplayOrRecord:
+	default:
+		return fmt.Errorf("unknown record mode \"%s\"", recorder.Mode)
+	}
+
+	if recorder.Directory == "" {
+		return fmt.Errorf("no record directory configured")
+	}
+	if len(recorder.Match) == 0 {
+		recorder.Match = []string{"method", "path", "query"}
+	}
+	for _, part := range recorder.Match {
+		switch part {
+		case "method", "path", "query", "headers", "body":
+		default:
+			return fmt.Errorf("unknown record match \"%s\"", part)
+		}
+	}
+	if len(recorder.Headers) > 0 && !recorder.matches("headers") {
+		recorder.Match = append(recorder.Match, "headers")
+	}
+
+	return os.MkdirAll(recorder.Directory, 0755)
+}
+
+func (recorder *Recorder) matches(part string) bool {
+	for _, p := range recorder.Match {
+		if p == part {
+			return true
+		}
+	}
+	return false
+}
+
+// recording returns whether responses are stored
+func (recorder *Recorder) recording() bool {
+	return recorder != nil && recorder.Mode != RecordModeReplay
+}
+
+// replaying returns whether stored responses are served
+func (recorder *Recorder) replaying() bool {
+	return recorder != nil && recorder.Mode != RecordModeRecord
+}
+
+// prepare reads the request body if it is part of the key and returns the path of the recording file
+func (recorder *Recorder) prepare(proxy *Proxy, req *http.Request) (string, error) {
+	path := strings.Replace(req.URL.Path, proxy.URLFrom, "", 1)
+
+	hash := sha256.New()
+	for _, part := range recorder.Match {
+		switch part {
+		case "method":
+			fmt.Fprintf(hash, "method:%s\n", req.Method)
+		case "path":
+			fmt.Fprintf(hash, "path:%s\n", path)
+		case "query":
+			fmt.Fprintf(hash, "query:%s\n", req.URL.Query().Encode())
+		case "headers":
+			for _, name := range recorder.Headers {
+				fmt.Fprintf(hash, "header:%s:%s\n", http.CanonicalHeaderKey(name), strings.Join(req.Header.Values(name), ","))
+			}
+		case "body":
+			body, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return "", err
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+			fmt.Fprintf(hash, "body:")
+			hash.Write(body)
+			fmt.Fprintf(hash, "\n")
+		}
+	}
+
+	// The readable prefix only contains the matched parts, so requests differing in other parts share the file
+	parts := []string{}
+	if recorder.matches("method") {
+		parts = append(parts, req.Method)
+	}
+	if recorder.matches("path") {
+		name := strings.Trim(recordNameCleaner.ReplaceAllString(path, "_"), "_")
+		if len(name) > 80 {
+			name = name[:80]
+		}
+		parts = append(parts, name)
+	}
+	parts = append(parts, hex.EncodeToString(hash.Sum(nil))[:16])
+
+	return filepath.Join(recorder.Directory, strings.Join(parts, "-")+".json"), nil
+}
+
+// replay sends the recorded response, it returns false if there is no recording
+func (recorder *Recorder) replay(file string, w http.ResponseWriter) bool {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+
+	exchange := &recordedExchange{}
+	err = json.Unmarshal(data, exchange)
+	if err != nil {
+		logError("Invalid recording \"%s\": %s\n", file, err.Error())
+		return false
+	}
+
+	body := []byte(exchange.Body)
+	if exchange.BodyEncoding == "base64" {
+		body, err = base64.StdEncoding.DecodeString(exchange.Body)
+		if err != nil {
+			logError("Invalid recording body \"%s\": %s\n", file, err.Error())
+			return false
+		}
+	}
+
+	// Hand-written recordings may omit the status
+	if exchange.Status == 0 {
+		exchange.Status = 200
+	}
+	if exchange.Status < 200 || exchange.Status > 999 {
+		logError("Invalid recording status \"%s\": %d\n", file, exchange.Status)
+		return false
+	}
+
+	logDebug("Replaying %s\n", file)
+
+	// Recordings may have been edited, so the content length is recalculated
+	exchange.Header.Del("Content-Length")
+
+	for name, values := range exchange.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(exchange.Status)
+	w.Write(body)
+
+	return true
+}
+
+// record stores the exchange in the given file
+func (recorder *Recorder) record(file string, proxy *Proxy, req *http.Request, resp *http.Response, body []byte) {
+	exchange := &recordedExchange{
+		Method: req.Method,
+		Path:   strings.Replace(req.URL.Path, proxy.URLFrom, "", 1),
+		Query:  req.URL.RawQuery,
+		Status: resp.StatusCode,
+		Header: resp.Header,
+		Body:   string(body),
+	}
+	if !utf8.Valid(body) {
+		exchange.Body = base64.StdEncoding.EncodeToString(body)
+		exchange.BodyEncoding = "base64"
+	}
+
+	data, err := json.MarshalIndent(exchange, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0644)
+	}
+	if err != nil {
+		logError("Could not store recording \"%s\": %s\n", file, err.Error())
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RetryPolicy describes when and how often failed requests to an upstream are repeated
+type RetryPolicy struct {
+	Attempts   int      `json:"attempts"`
+	Methods    []string `json:"methods"`
+	Status     []int    `json:"status"`
+	Backoff    Duration `json:"backoff"`
+	MaxBackoff Duration `json:"max-backoff"`
+	MaxBody    int64    `json:"max-body"`
+}
+
+// idempotentMethods can always be retried, see https://tools.ietf.org/html/rfc7231#section-4.2.2
+var idempotentMethods = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+/////////////////////////////// Retries ///////////////////////////////
+
+// retryable returns whether requests with the given method may be retried
+func (policy *RetryPolicy) retryable(method string) bool {
+	if policy == nil || policy.Attempts <= 1 {
+		return false
+	}
+	for _, m := range idempotentMethods {
+		if m == method {
+			return true
+		}
+	}
+	for _, m := range policy.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// bufferBody reads the request body into memory if the request may be sent more than once, mirrored or passed to a
+// fallback plugin. The second return value is false if the body was not buffered, in that case the request body can
+// only be sent once.
+func (proxy *Proxy) bufferBody(req *http.Request) ([]byte, bool, error) {
+	fallbackPlugin := proxy.Fallback != nil && proxy.Fallback.plugin != nil
+	if !proxy.Retry.retryable(req.Method) && !proxy.CSRF.protects(req.Method) && !fallbackPlugin && proxy.Mirror == nil {
+		return nil, false, nil
+	}
+
+	var limit int64
+	if proxy.Retry != nil {
+		limit = proxy.Retry.MaxBody
+	}
+	if limit <= 0 && proxy.Mirror != nil {
+		limit = proxy.Mirror.MaxBody
+	}
+	if limit <= 0 {
+		limit = 1024 * 1024
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if int64(len(body)) > limit {
+		// Body is too large to be buffered, send the part already read followed by the rest of the body
+		req.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+		return nil, false, nil
+	}
+
+	return body, true, nil
+}
+
+// shouldRetry decides whether the given attempt is repeated based on its result
+func (policy *RetryPolicy) shouldRetry(attempt int, method string, resp *http.Response, err error) bool {
+	if !policy.retryable(method) || attempt >= policy.Attempts || err == errCircuitOpen {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+
+	status := policy.Status
+	if status == nil {
+		status = []int{502, 503, 504}
+	}
+	for _, code := range status {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns the exponential delay with jitter before the next attempt
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := policy.Backoff.Or(100 * time.Millisecond)
+	maxDelay := policy.MaxBackoff.Or(5 * time.Second)
+
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+
+	// Use half of the delay as fixed part and randomize the rest
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
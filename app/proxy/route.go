@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// RouteOptions contains the settings supported by proxy and plugin entries alike
+type RouteOptions struct {
+	CORS      *CORSPolicy      `json:"cors"`
+	Faults    *FaultInjection  `json:"faults"`
+	Timeouts  *Timeouts        `json:"timeouts"`
+	Logging   *TrafficLog      `json:"logging"`
+	Transform []*TransformRule `json:"transform"`
+
+	path     string
+	timeouts *Timeouts
+}
+
+/////////////////////////////// Route Options ///////////////////////////////
+
+func (options *RouteOptions) init(path string, defaults *Timeouts) error {
+	options.path = path
+	options.timeouts = options.Timeouts.merge(defaults)
+
+	err := options.CORS.init()
+	if err == nil {
+		err = options.Faults.init()
+	}
+	if err == nil {
+		err = options.Logging.init()
+	}
+	for i, rule := range options.Transform {
+		if err == nil {
+			err = rule.init()
+			if err != nil {
+				err = fmt.Errorf("transform rule %d: %s", i+1, err.Error())
+			}
+		}
+	}
+	return err
+}
+
+// handle applies the route options to the request and calls next to create the response unless the request has
+// already been answered
+func (options *RouteOptions) handle(w http.ResponseWriter, req *http.Request, next func(http.ResponseWriter)) {
+	options.timeouts.applyDeadlines(w)
+
+	if options.Logging != nil {
+		capture := options.Logging.capture(w, req)
+		defer capture.finish()
+		w = capture
+	}
+
+	if options.CORS != nil {
+		if options.CORS.handlePreflight(w, req) {
+			return
+		}
+		w = options.CORS.wrap(w, req)
+	}
+
+	if len(options.Transform) > 0 {
+		next = transformResponses(options.Transform, req, next)
+	}
+
+	if options.Faults.active() {
+		options.Faults.handle(w, req, next)
+		return
+	}
+
+	next(w)
+}
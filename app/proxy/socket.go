@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// UpstreamSocketPrefix marks upstream URLs pointing to unix domain sockets, for example "unix:/var/run/app.sock" or
+// "unix:/var/run/app.sock:/base/path/"
+const UpstreamSocketPrefix = "unix:"
+
+// socketHostSuffix is appended to the host names standing in for sockets in the upstream request URLs
+const socketHostSuffix = ".socket.localhost"
+
+/////////////////////////////// Unix Sockets ///////////////////////////////
+
+// parseSocketURL splits an upstream socket URL into the socket path and the base path of the requests
+func parseSocketURL(upstreamURL string) (string, string, error) {
+	socket := strings.TrimPrefix(upstreamURL, UpstreamSocketPrefix)
+	base := "/"
+	if index := strings.Index(socket, ":"); index >= 0 {
+		socket, base = socket[:index], socket[index+1:]
+	}
+	if socket == "" {
+		return "", "", fmt.Errorf("no socket path in upstream \"%s\"", upstreamURL)
+	}
+	if !strings.HasPrefix(base, "/") {
+		base = "/" + base
+	}
+	return socket, base, nil
+}
+
+// createDialer returns the dial function of the upstream transport, connections to the host names standing in for
+// sockets are made to the socket files
+func createDialer(proxy *Proxy) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout: time.Duration(proxy.timeouts.Dial),
+	}
+
+	sockets := map[string]string{}
+	for _, upstream := range proxy.targets() {
+		if upstream.socket != "" {
+			sockets[upstream.target.Host+":80"] = upstream.socket
+		}
+	}
+
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if socket, ok := sockets[address]; ok {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		return dialer.DialContext(ctx, network, address)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Timeouts describes the time limits of the server, the upstream requests and the plugin executions
+type Timeouts struct {
+	Read           Duration `json:"read"`
+	Write          Duration `json:"write"`
+	Idle           Duration `json:"idle"`
+	Dial           Duration `json:"dial"`
+	TLSHandshake   Duration `json:"tls-handshake"`
+	ResponseHeader Duration `json:"response-header"`
+	Total          Duration `json:"total"`
+	Plugin         Duration `json:"plugin"`
+}
+
+var defaultTimeouts = Timeouts{
+	Read:         Duration(5 * time.Second),
+	Write:        Duration(10 * time.Second),
+	Idle:         Duration(120 * time.Second),
+	Dial:         Duration(10 * time.Second),
+	TLSHandshake: Duration(10 * time.Second),
+	Total:        Duration(60 * time.Second),
+	Plugin:       Duration(10 * time.Second),
+}
+
+/////////////////////////////// Timeouts ///////////////////////////////
+
+// merge returns a copy of the timeouts in which all unset values are taken from the defaults
+func (timeouts *Timeouts) merge(defaults *Timeouts) *Timeouts {
+	merged := *defaults
+	if timeouts == nil {
+		return &merged
+	}
+
+	for _, value := range []struct {
+		merged *Duration
+		custom Duration
+	}{
+		{&merged.Read, timeouts.Read},
+		{&merged.Write, timeouts.Write},
+		{&merged.Idle, timeouts.Idle},
+		{&merged.Dial, timeouts.Dial},
+		{&merged.TLSHandshake, timeouts.TLSHandshake},
+		{&merged.ResponseHeader, timeouts.ResponseHeader},
+		{&merged.Total, timeouts.Total},
+		{&merged.Plugin, timeouts.Plugin},
+	} {
+		if value.custom > 0 {
+			*value.merged = value.custom
+		}
+	}
+	return &merged
+}
+
+// routeDefaults returns the defaults for proxy and plugin routes. Their responses are not limited by the server write
+// timeout, since the total and plugin timeouts already limit the time spent on them.
+func (timeouts *Timeouts) routeDefaults() *Timeouts {
+	defaults := *timeouts
+	defaults.Write = 0
+	return &defaults
+}
+
+// applyDeadlines sets the read and write deadlines of the connection for the current request, a timeout of 0
+// removes the deadline set by the server
+func (timeouts *Timeouts) applyDeadlines(w http.ResponseWriter) {
+	controller := http.NewResponseController(w)
+	now := time.Now()
+
+	if timeouts.Read > 0 {
+		controller.SetReadDeadline(now.Add(time.Duration(timeouts.Read)))
+	} else {
+		controller.SetReadDeadline(time.Time{})
+	}
+	if timeouts.Write > 0 {
+		controller.SetWriteDeadline(now.Add(time.Duration(timeouts.Write)))
+	} else {
+		controller.SetWriteDeadline(time.Time{})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// UpstreamTLS describes the TLS settings used for the connections to the upstreams of a proxy entry
+type UpstreamTLS struct {
+	CA         string   `json:"ca"`
+	Cert       string   `json:"cert"`
+	Key        string   `json:"key"`
+	PKCS12     string   `json:"pkcs12"`
+	Password   string   `json:"password"`
+	MinVersion string   `json:"min-version"`
+	ServerName string   `json:"server-name"`
+	Pins       []string `json:"pins"`
+}
+
+// ServerTLS describes the certificate used to serve HTTPS, which also enables HTTP/2 for the browsers
+type ServerTLS struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+/////////////////////////////// Upstream TLS ///////////////////////////////
+
+// createTLSConfig creates the TLS client configuration for the upstream connections
+func createTLSConfig(settings *UpstreamTLS, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: insecure,
+	}
+	if settings == nil {
+		return tlsConfig, nil
+	}
+
+	if settings.CA != "" {
+		pem, err := ioutil.ReadFile(settings.CA)
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA file \"%s\"", settings.CA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if settings.Cert != "" || settings.Key != "" {
+		keyFile := settings.Key
+		if keyFile == "" {
+			// Certificate and key may be stored in the same file
+			keyFile = settings.Cert
+		}
+		cert, err := tls.LoadX509KeyPair(settings.Cert, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if settings.PKCS12 != "" {
+		cert, err := loadPKCS12(settings.PKCS12, settings.Password)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = append(tlsConfig.Certificates, cert)
+	}
+
+	if settings.MinVersion != "" {
+		version, ok := tlsVersions[settings.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version \"%s\"", settings.MinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	tlsConfig.ServerName = settings.ServerName
+
+	if len(settings.Pins) > 0 {
+		pins := make([][]byte, len(settings.Pins))
+		for i, pin := range settings.Pins {
+			fingerprint, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+			if err != nil || len(fingerprint) != sha256.Size {
+				return nil, fmt.Errorf("invalid SHA-256 certificate fingerprint \"%s\"", pin)
+			}
+			pins[i] = fingerprint
+		}
+
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("no server certificate to check against the pinned fingerprints")
+			}
+			fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+			for _, pin := range pins {
+				if bytes.Equal(pin, fingerprint[:]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("server certificate fingerprint %s is not pinned", hex.EncodeToString(fingerprint[:]))
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// loadPKCS12 reads a client certificate with its private key and chain from a PKCS#12 file
+func loadPKCS12(file string, password string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, cert, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("PKCS#12 file \"%s\": %s", file, err.Error())
+	}
+
+	certificate := tls.Certificate{
+		Certificate: [][]byte{cert.Raw},
+		PrivateKey:  key,
+		Leaf:        cert,
+	}
+	for _, c := range chain {
+		certificate.Certificate = append(certificate.Certificate, c.Raw)
+	}
+
+	return certificate, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TrafficLog describes which details of the exchanges of a route are written to the console
+type TrafficLog struct {
+	Details       []string `json:"details"`
+	MaxBody       int      `json:"max-body"`
+	RedactHeaders []string `json:"redact-headers"`
+	RedactFields  []string `json:"redact-fields"`
+
+	headers      bool
+	requestBody  bool
+	responseBody bool
+}
+
+// trafficCapture records an exchange for the traffic log
+type trafficCapture struct {
+	http.ResponseWriter
+	log         *TrafficLog
+	req         *http.Request
+	header      http.Header
+	started     time.Time
+	status      int
+	requestBody *cappedBuffer
+	body        *cappedBuffer
+}
+
+const redacted = "[REDACTED]"
+
+var defaultRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+/////////////////////////////// Traffic Log ///////////////////////////////
+
+func (traffic *TrafficLog) init() error {
+	if traffic == nil {
+		return nil
+	}
+	if traffic.MaxBody <= 0 {
+		traffic.MaxBody = 4096
+	}
+	if traffic.RedactHeaders == nil {
+		traffic.RedactHeaders = defaultRedactHeaders
+	}
+
+	for _, detail := range traffic.Details {
+		switch detail {
+		case "headers":
+			traffic.headers = true
+		case "request-body":
+			traffic.requestBody = true
+		case "response-body":
+			traffic.responseBody = true
+		default:
+			return fmt.Errorf("unknown logging detail \"%s\"", detail)
+		}
+	}
+	return nil
+}
+
+// capture wraps the response writer and request body so the exchange can be logged
+func (traffic *TrafficLog) capture(w http.ResponseWriter, req *http.Request) *trafficCapture {
+	capture := &trafficCapture{
+		ResponseWriter: w,
+		log:            traffic,
+		req:            req,
+		started:        time.Now(),
+		requestBody:    &cappedBuffer{},
+		body:           &cappedBuffer{},
+	}
+	if traffic.requestBody {
+		capture.requestBody.max = traffic.MaxBody
+	}
+	if traffic.responseBody {
+		capture.body.max = traffic.MaxBody
+	}
+
+	if traffic.requestBody && req.Body != nil {
+		req.Body = &teeReadCloser{Reader: io.TeeReader(req.Body, capture.requestBody), Closer: req.Body}
+	}
+
+	return capture
+}
+
+func (capture *trafficCapture) WriteHeader(status int) {
+	// Informational responses are sent before the final response
+	if capture.status == 0 && status >= 200 {
+		capture.status = status
+		capture.header = capture.Header().Clone()
+	}
+	capture.ResponseWriter.WriteHeader(status)
+}
+
+func (capture *trafficCapture) Write(data []byte) (int, error) {
+	if capture.status == 0 {
+		capture.WriteHeader(200)
+	}
+	capture.body.Write(data)
+	return capture.ResponseWriter.Write(data)
+}
+
+// Flush implements http.Flusher
+func (capture *trafficCapture) Flush() {
+	if flusher, ok := capture.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped response writer for http.ResponseController
+func (capture *trafficCapture) Unwrap() http.ResponseWriter {
+	return capture.ResponseWriter
+}
+
+// finish writes the captured exchange to the console
+func (capture *trafficCapture) finish() {
+	if capture.status == 0 {
+		capture.status = 200
+		capture.header = capture.Header().Clone()
+	}
+	traffic := capture.log
+	req := capture.req
+
+	out := &strings.Builder{}
+	fmt.Fprintf(out, "%s %s => %d (%s)\n", req.Method, req.URL.RequestURI(), capture.status,
+		time.Since(capture.started).Round(time.Millisecond))
+
+	if traffic.headers {
+		traffic.writeHeaders(out, "> ", req.Header)
+	}
+	if traffic.requestBody {
+		traffic.writeBody(out, "> ", req.Header, capture.requestBody)
+	}
+	if traffic.headers {
+		traffic.writeHeaders(out, "< ", capture.header)
+	}
+	if traffic.responseBody {
+		traffic.writeBody(out, "< ", capture.header, capture.body)
+	}
+
+	logStd("%s", out.String())
+}
+
+func (traffic *TrafficLog) writeHeaders(out *strings.Builder, prefix string, header http.Header) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range header[name] {
+			if traffic.redactsHeader(name) {
+				value = redacted
+			}
+			fmt.Fprintf(out, "%s%s: %s\n", prefix, name, value)
+		}
+	}
+}
+
+func (traffic *TrafficLog) redactsHeader(name string) bool {
+	for _, redact := range traffic.RedactHeaders {
+		if strings.EqualFold(redact, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (traffic *TrafficLog) writeBody(out *strings.Builder, prefix string, header http.Header, body *cappedBuffer) {
+	if body.total == 0 {
+		return
+	}
+
+	complete := body.total == int64(body.Len())
+	var text string
+
+	switch {
+	case header.Get("Content-Encoding") != "" && header.Get("Content-Encoding") != "identity":
+		text = fmt.Sprintf("[%d bytes, %s encoded]", body.total, header.Get("Content-Encoding"))
+
+	case strings.Contains(header.Get("Content-Type"), "json"):
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body.Bytes()))
+		decoder.UseNumber()
+		if complete && decoder.Decode(&value) == nil {
+			value = traffic.redactJSON(value, nil)
+			pretty, _ := json.MarshalIndent(value, "", "  ")
+			text = string(pretty)
+		} else if len(traffic.RedactFields) > 0 {
+			// Fields cannot be redacted reliably in incomplete or invalid JSON
+			text = fmt.Sprintf("[%d bytes of JSON that cannot be redacted]", body.total)
+		} else {
+			text = body.String()
+		}
+
+	case !utf8.Valid(body.Bytes()):
+		text = fmt.Sprintf("[%d bytes of binary data]", body.total)
+
+	default:
+		text = body.String()
+	}
+
+	if !complete && !strings.HasPrefix(text, "[") {
+		text += fmt.Sprintf("\n[%d of %d bytes]", body.Len(), body.total)
+	}
+	fmt.Fprintf(out, "%s\n", prefix)
+	for _, line := range strings.Split(text, "\n") {
+		fmt.Fprintf(out, "%s%s\n", prefix, line)
+	}
+}
+
+// redactJSON replaces the values of redacted fields. Rules without "." match fields of that name anywhere, other rules
+// are paths of field names and array indexes from the root, in which "*" matches any field or index.
+func (traffic *TrafficLog) redactJSON(value interface{}, path []string) interface{} {
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		for name, field := range typed {
+			fieldPath := append(append([]string{}, path...), name)
+			if traffic.redactsField(fieldPath) {
+				typed[name] = redacted
+			} else {
+				typed[name] = traffic.redactJSON(field, fieldPath)
+			}
+		}
+	case []interface{}:
+		for i, element := range typed {
+			elementPath := append(append([]string{}, path...), strconv.Itoa(i))
+			typed[i] = traffic.redactJSON(element, elementPath)
+		}
+	}
+	return value
+}
+
+func (traffic *TrafficLog) redactsField(path []string) bool {
+	for _, rule := range traffic.RedactFields {
+		if !strings.Contains(rule, ".") {
+			if rule == path[len(path)-1] {
+				return true
+			}
+			continue
+		}
+
+		segments := strings.Split(strings.TrimPrefix(rule, "$."), ".")
+		if len(segments) != len(path) {
+			continue
+		}
+		matches := true
+		for i, segment := range segments {
+			matches = matches && (segment == "*" || segment == path[i])
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
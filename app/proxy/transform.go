@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TransformRule describes a change of JSON responses, each rule contains one operation applied to all values
+// selected by the path
+type TransformRule struct {
+	Path   string                     `json:"path"`
+	Pick   []string                   `json:"pick"`
+	Omit   []string                   `json:"omit"`
+	Rename map[string]string          `json:"rename"`
+	Set    map[string]json.RawMessage `json:"set"`
+	Filter string                     `json:"filter"`
+	Wrap   string                     `json:"wrap"`
+	Unwrap string                     `json:"unwrap"`
+
+	path      []pathSegment
+	unwrap    []pathSegment
+	predicate *predicate
+	values    map[string]interface{}
+}
+
+// pathSegment is a field name or array index of a path, the wildcard "*" matches all fields or elements
+type pathSegment struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// predicate compares the value at a path with a constant, without operator the value must be truthy
+type predicate struct {
+	path     []pathSegment
+	operator string
+	value    interface{}
+}
+
+// transformWriter buffers JSON responses so they can be transformed
+type transformWriter struct {
+	http.ResponseWriter
+	rules     []*TransformRule
+	method    string
+	status    int
+	buffering bool
+	body      bytes.Buffer
+}
+
+var (
+	pathSegmentPattern = regexp.MustCompile(`^(?:\.([^.\[]+)|\[(\d+|\*)\]|\["((?:[^"\\]|\\.)*)"\])`)
+	predicatePattern   = regexp.MustCompile(`^\s*(\S+)\s*(==|!=|<=|>=|<|>)\s*(.+?)\s*$`)
+)
+
+/////////////////////////////// Transformations ///////////////////////////////
+
+// parsePath parses path expressions like "$.items[*].name", "$['odd name']" or "items[0]"
+func parsePath(expression string) ([]pathSegment, error) {
+	rest := strings.TrimSpace(expression)
+	rest = strings.TrimPrefix(strings.TrimPrefix(rest, "$"), "@")
+	if rest != "" && !strings.HasPrefix(rest, ".") && !strings.HasPrefix(rest, "[") {
+		rest = "." + rest
+	}
+
+	segments := []pathSegment{}
+	for rest != "" {
+		match := pathSegmentPattern.FindStringSubmatch(rest)
+		if match == nil {
+			return nil, fmt.Errorf("invalid path \"%s\" at \"%s\"", expression, rest)
+		}
+		rest = rest[len(match[0]):]
+
+		switch {
+		case match[1] == "*" || match[2] == "*":
+			segments = append(segments, pathSegment{wildcard: true})
+		case match[1] != "":
+			segments = append(segments, pathSegment{name: match[1]})
+		case match[2] != "":
+			index, _ := strconv.Atoi(match[2])
+			segments = append(segments, pathSegment{index: index, isIndex: true})
+		default:
+			name, err := strconv.Unquote("\"" + match[3] + "\"")
+			if err != nil {
+				return nil, fmt.Errorf("invalid path \"%s\": %s", expression, err.Error())
+			}
+			segments = append(segments, pathSegment{name: name})
+		}
+	}
+	return segments, nil
+}
+
+// parsePredicate parses predicates like "price > 10", "status == \"active\"" or "enabled"
+func parsePredicate(expression string) (*predicate, error) {
+	match := predicatePattern.FindStringSubmatch(expression)
+	if match == nil {
+		path, err := parsePath(expression)
+		return &predicate{path: path}, err
+	}
+
+	path, err := parsePath(match[1])
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal([]byte(match[3]), &value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value in filter \"%s\": %s", expression, err.Error())
+	}
+	return &predicate{path: path, operator: match[2], value: value}, nil
+}
+
+func (rule *TransformRule) init() error {
+	operations := 0
+	for _, used := range []bool{rule.Pick != nil, rule.Omit != nil, rule.Rename != nil, rule.Set != nil,
+		rule.Filter != "", rule.Wrap != "", rule.Unwrap != ""} {
+		if used {
+			operations++
+		}
+	}
+	if operations != 1 {
+		return errors.New("each transform rule needs exactly one operation")
+	}
+
+	var err error
+	rule.path, err = parsePath(rule.Path)
+	if err == nil && rule.Unwrap != "" {
+		rule.unwrap, err = parsePath(rule.Unwrap)
+	}
+	if err == nil && rule.Filter != "" {
+		rule.predicate, err = parsePredicate(rule.Filter)
+	}
+	if err != nil {
+		return err
+	}
+
+	rule.values = map[string]interface{}{}
+	for name, raw := range rule.Set {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		err = decoder.Decode(&value)
+		if err != nil {
+			return fmt.Errorf("invalid value for \"%s\": %s", name, err.Error())
+		}
+		rule.values[name] = value
+	}
+	return nil
+}
+
+// apply returns the document with the operation applied to all values selected by the path
+func (rule *TransformRule) apply(document interface{}) interface{} {
+	return applyAt(document, rule.path, rule.transform)
+}
+
+func (rule *TransformRule) transform(value interface{}) interface{} {
+	object, isObject := value.(map[string]interface{})
+
+	switch {
+	case rule.Pick != nil && isObject:
+		picked := map[string]interface{}{}
+		for _, name := range rule.Pick {
+			if field, ok := object[name]; ok {
+				picked[name] = field
+			}
+		}
+		return picked
+
+	case rule.Omit != nil && isObject:
+		for _, name := range rule.Omit {
+			delete(object, name)
+		}
+
+	case rule.Rename != nil && isObject:
+		renamed := map[string]interface{}{}
+		for name, field := range object {
+			if newName, ok := rule.Rename[name]; ok {
+				name = newName
+			}
+			renamed[name] = field
+		}
+		return renamed
+
+	case rule.Set != nil && isObject:
+		for name, field := range rule.values {
+			object[name] = field
+		}
+
+	case rule.predicate != nil:
+		if array, ok := value.([]interface{}); ok {
+			filtered := []interface{}{}
+			for _, element := range array {
+				if rule.predicate.matches(element) {
+					filtered = append(filtered, element)
+				}
+			}
+			return filtered
+		}
+
+	case rule.Wrap != "":
+		return map[string]interface{}{rule.Wrap: value}
+
+	case rule.unwrap != nil:
+		if unwrapped, ok := lookup(value, rule.unwrap); ok {
+			return unwrapped
+		}
+	}
+
+	return value
+}
+
+// applyAt replaces all values selected by the path with the result of the transformation
+func applyAt(value interface{}, path []pathSegment, transform func(interface{}) interface{}) interface{} {
+	if len(path) == 0 {
+		return transform(value)
+	}
+	segment, rest := path[0], path[1:]
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if segment.wildcard {
+			for name, field := range typed {
+				typed[name] = applyAt(field, rest, transform)
+			}
+		} else if field, ok := typed[segment.name]; ok && !segment.isIndex {
+			typed[segment.name] = applyAt(field, rest, transform)
+		}
+	case []interface{}:
+		if segment.wildcard {
+			for i, element := range typed {
+				typed[i] = applyAt(element, rest, transform)
+			}
+		} else if segment.isIndex && segment.index < len(typed) {
+			typed[segment.index] = applyAt(typed[segment.index], rest, transform)
+		}
+	}
+	return value
+}
+
+// lookup returns the value at the path, wildcards select the first matching value
+func lookup(value interface{}, path []pathSegment) (interface{}, bool) {
+	for i, segment := range path {
+		switch typed := value.(type) {
+		case map[string]interface{}:
+			if segment.wildcard {
+				for _, field := range typed {
+					if found, ok := lookup(field, path[i+1:]); ok {
+						return found, true
+					}
+				}
+				return nil, false
+			}
+			field, ok := typed[segment.name]
+			if !ok || segment.isIndex {
+				return nil, false
+			}
+			value = field
+		case []interface{}:
+			if segment.wildcard {
+				for _, element := range typed {
+					if found, ok := lookup(element, path[i+1:]); ok {
+						return found, true
+					}
+				}
+				return nil, false
+			}
+			if !segment.isIndex || segment.index >= len(typed) {
+				return nil, false
+			}
+			value = typed[segment.index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func (predicate *predicate) matches(element interface{}) bool {
+	value, found := lookup(element, predicate.path)
+	if number, ok := value.(json.Number); ok {
+		value, _ = number.Float64()
+	}
+
+	switch predicate.operator {
+	case "":
+		return found && value != nil && value != false && value != "" && value != float64(0)
+	case "==":
+		return found && reflect.DeepEqual(value, predicate.value)
+	case "!=":
+		return !found || !reflect.DeepEqual(value, predicate.value)
+	}
+
+	comparison := 0
+	switch left := value.(type) {
+	case float64:
+		right, ok := predicate.value.(float64)
+		if !ok {
+			return false
+		}
+		if left < right {
+			comparison = -1
+		} else if left > right {
+			comparison = 1
+		}
+	case string:
+		right, ok := predicate.value.(string)
+		if !ok {
+			return false
+		}
+		comparison = strings.Compare(left, right)
+	default:
+		return false
+	}
+
+	switch predicate.operator {
+	case "<":
+		return comparison < 0
+	case "<=":
+		return comparison <= 0
+	case ">":
+		return comparison > 0
+	default:
+		return comparison >= 0
+	}
+}
+
+/////////////////////////////// Transform Writer ///////////////////////////////
+
+// isJSON returns whether the content type is application/json or a JSON based type like application/problem+json.
+// Streaming types like application/x-ndjson or application/grpc+json are not matched.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" ||
+		strings.HasSuffix(mediaType, "+json") && !strings.HasPrefix(mediaType, "application/grpc")
+}
+
+// transformResponses wraps the handler so its JSON responses are transformed
+func transformResponses(rules []*TransformRule, req *http.Request, next func(http.ResponseWriter)) func(http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		// Compressed responses cannot be transformed
+		req.Header.Del("Accept-Encoding")
+
+		writer := &transformWriter{ResponseWriter: w, rules: rules, method: req.Method}
+		next(writer)
+		writer.finish()
+	}
+}
+
+func (writer *transformWriter) WriteHeader(status int) {
+	if writer.status != 0 || status < 200 {
+		writer.ResponseWriter.WriteHeader(status)
+		return
+	}
+	writer.status = status
+
+	header := writer.Header()
+	encoding := header.Get("Content-Encoding")
+	// Responses without body are left untouched
+	writer.buffering = isJSON(header.Get("Content-Type")) && (encoding == "" || encoding == "identity") &&
+		writer.method != "HEAD" && status != 204 && status != 304
+	if !writer.buffering {
+		writer.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (writer *transformWriter) Write(data []byte) (int, error) {
+	if writer.status == 0 {
+		writer.WriteHeader(200)
+	}
+	if writer.buffering {
+		return writer.body.Write(data)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+// Flush implements http.Flusher, buffered responses are sent when they are complete
+func (writer *transformWriter) Flush() {
+	if writer.buffering {
+		return
+	}
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the wrapped response writer for http.ResponseController
+func (writer *transformWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// finish transforms and sends a buffered response
+func (writer *transformWriter) finish() {
+	if !writer.buffering {
+		return
+	}
+	body := writer.body.Bytes()
+
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err := decoder.Decode(&document)
+	if err == nil {
+		for _, rule := range writer.rules {
+			document = rule.apply(document)
+		}
+		var transformed []byte
+		transformed, err = json.Marshal(document)
+		if err == nil {
+			body = transformed
+		}
+	}
+	if err != nil && len(body) > 0 {
+		logDebug("Response cannot be transformed: %s\n", err.Error())
+	}
+
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.ResponseWriter.WriteHeader(writer.status)
+	writer.ResponseWriter.Write(body)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		expression string
+		segments   []pathSegment
+		invalid    bool
+	}{
+		{"", []pathSegment{}, false},
+		{"$", []pathSegment{}, false},
+		{"$.items", []pathSegment{{name: "items"}}, false},
+		{"items", []pathSegment{{name: "items"}}, false},
+		{"@.a.b", []pathSegment{{name: "a"}, {name: "b"}}, false},
+		{"$.items[2].name", []pathSegment{{name: "items"}, {index: 2, isIndex: true}, {name: "name"}}, false},
+		{"$[*].id", []pathSegment{{wildcard: true}, {name: "id"}}, false},
+		{"$.a.*", []pathSegment{{name: "a"}, {wildcard: true}}, false},
+		{`$["odd name"]`, []pathSegment{{name: "odd name"}}, false},
+		{`$["quote \" inside"]`, []pathSegment{{name: `quote " inside`}}, false},
+		{"$.items[", nil, true},
+		{"$.items[x]", nil, true},
+		{"$..a", nil, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			segments, err := parsePath(test.expression)
+			if test.invalid {
+				if err == nil {
+					t.Errorf("expected an error, got %v", segments)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if !reflect.DeepEqual(segments, test.segments) {
+				t.Errorf("segments = %+v, want %+v", segments, test.segments)
+			}
+		})
+	}
+}
+
+func TestPredicateMatches(t *testing.T) {
+	element := decodeTestJSON(t, `{"price": 12.5, "name": "b", "enabled": true, "zero": 0, "empty": "",
+		"tags": ["x"], "nested": {"level": 3}}`)
+
+	tests := []struct {
+		expression string
+		matches    bool
+	}{
+		{"price > 10", true},
+		{"price >= 12.5", true},
+		{"price < 12.5", false},
+		{"price <= 12", false},
+		{"price == 12.5", true},
+		{"price != 12.5", false},
+		{`name == "b"`, true},
+		{`name > "a"`, true},
+		{`name < "a"`, false},
+		{`price > "a"`, false},
+		{"missing != 1", true},
+		{"missing == 1", false},
+		{"nested.level == 3", true},
+		{"tags[0] == \"x\"", true},
+		{"enabled", true},
+		{"zero", false},
+		{"empty", false},
+		{"missing", false},
+		{"enabled == true", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			predicate, err := parsePredicate(test.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+			if matches := predicate.matches(element); matches != test.matches {
+				t.Errorf("matches = %t, want %t", matches, test.matches)
+			}
+		})
+	}
+}
+
+func TestParsePredicateInvalid(t *testing.T) {
+	for _, expression := range []string{"price > ten", "a[ == 1"} {
+		if _, err := parsePredicate(expression); err == nil {
+			t.Errorf("expected an error for %q", expression)
+		}
+	}
+}
+
+func TestTransformRules(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		document string
+		expected string
+	}{
+		{"pick", `{"pick": ["a"]}`, `{"a": 1, "b": 2}`, `{"a": 1}`},
+		{"omit in array", `{"path": "$[*]", "omit": ["secret"]}`, `[{"a": 1, "secret": 2}]`, `[{"a": 1}]`},
+		{"rename", `{"rename": {"a": "b"}}`, `{"a": 1}`, `{"b": 1}`},
+		{"set keeps precision", `{"set": {"n": 12345678901234567890}}`, `{}`, `{"n": 12345678901234567890}`},
+		{"filter", `{"path": "items", "filter": "price >= 10"}`, `{"items": [{"price": 5}, {"price": 10}]}`,
+			`{"items": [{"price": 10}]}`},
+		{"wrap", `{"wrap": "data"}`, `[1]`, `{"data": [1]}`},
+		{"unwrap", `{"unwrap": "d.results"}`, `{"d": {"results": [1]}}`, `[1]`},
+		{"unwrap missing", `{"unwrap": "d.results"}`, `{"x": 1}`, `{"x": 1}`},
+		{"path does not match", `{"path": "missing", "omit": ["a"]}`, `{"a": 1}`, `{"a": 1}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := &TransformRule{}
+			if err := json.Unmarshal([]byte(test.rule), rule); err != nil {
+				t.Fatal(err)
+			}
+			if err := rule.init(); err != nil {
+				t.Fatalf("unexpected error: %s", err.Error())
+			}
+
+			transformed, err := json.Marshal(rule.apply(decodeTestJSON(t, test.document)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected, _ := json.Marshal(decodeTestJSON(t, test.expected))
+			if !bytes.Equal(transformed, expected) {
+				t.Errorf("result = %s, want %s", transformed, expected)
+			}
+		})
+	}
+}
+
+func TestTransformRuleOperations(t *testing.T) {
+	for _, rule := range []*TransformRule{{}, {Pick: []string{"a"}, Wrap: "b"}} {
+		if err := rule.init(); err == nil {
+			t.Errorf("expected an error for %+v", rule)
+		}
+	}
+}
+
+func TestIsJSON(t *testing.T) {
+	tests := map[string]bool{
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"application/problem+json":        true,
+		"application/vnd.api+json":        true,
+		"application/x-ndjson":            false,
+		"application/grpc+json":           false,
+		"application/jsonl":               false,
+		"text/plain":                      false,
+		"":                                false,
+	}
+	for contentType, expected := range tests {
+		if isJSON(contentType) != expected {
+			t.Errorf("isJSON(%q) = %t, want %t", contentType, !expected, expected)
+		}
+	}
+}
+
+func TestTransformWriter(t *testing.T) {
+	rule := &TransformRule{Wrap: "data"}
+	if err := rule.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		status      int
+		contentType string
+		body        string
+		expected    string
+		length      string
+	}{
+		{"json", "GET", 200, "application/json", `[1]`, `{"data":[1]}`, "12"},
+		{"text", "GET", 200, "text/plain", `[1]`, `[1]`, ""},
+		{"ndjson", "GET", 200, "application/x-ndjson", "{}\n{}\n", "{}\n{}\n", ""},
+		{"head", "HEAD", 200, "application/json", "", "", ""},
+		{"no content", "GET", 204, "application/json", "", "", ""},
+		{"not modified", "GET", 304, "application/json", "", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/", nil)
+			recorder := httptest.NewRecorder()
+			handler := transformResponses([]*TransformRule{rule}, req, func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", test.contentType)
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			})
+			handler(recorder)
+
+			if recorder.Code != test.status {
+				t.Errorf("status = %d, want %d", recorder.Code, test.status)
+			}
+			if body := recorder.Body.String(); body != test.expected {
+				t.Errorf("body = %q, want %q", body, test.expected)
+			}
+			if length := recorder.Header().Get("Content-Length"); length != test.length {
+				t.Errorf("Content-Length = %q, want %q", length, test.length)
+			}
+		})
+	}
+}
+
+func decodeTestJSON(t *testing.T, document string) interface{} {
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(document)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("invalid test document %q: %s", document, err.Error())
+	}
+	return value
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+/////////////////////////////// Protocol Upgrades ///////////////////////////////
+
+// upgrade forwards a request for a protocol upgrade like WebSocket and connects the client with the upstream
+// connection once the upstream agreed to the upgrade
+func (proxy *Proxy) upgrade(w http.ResponseWriter, req *http.Request) {
+	upstream := proxy.selectUpstream(req)
+	newReq, target, err := createProxyRequest(proxy, upstream, req, req.Body)
+	if err != nil {
+		w.WriteHeader(503)
+		w.Write([]byte("Proxy Error: " + err.Error()))
+		return
+	}
+	for _, cookie := range proxy.client.Jar.Cookies(target) {
+		newReq.AddCookie(cookie)
+	}
+
+	if proxy.Log {
+		logStd("%s %s (Upgrade: %s)\n", newReq.Method, newReq.URL.String(), newReq.Header.Get("Upgrade"))
+	}
+
+	release := upstream.acquire()
+	defer release()
+
+	// The client would wrap the body of the response, which is the upstream connection after the upgrade
+	resp, err := proxy.client.Transport.RoundTrip(newReq)
+	if err != nil {
+		upstream.reportFailure(proxy)
+		w.WriteHeader(503)
+		w.Write([]byte("Proxy Error: " + err.Error()))
+		return
+	}
+	upstream.reportSuccess()
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		writeResponseHeader(w, resp)
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+		return
+	}
+
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		w.WriteHeader(502)
+		w.Write([]byte("Proxy Error: upstream connection cannot be upgraded"))
+		return
+	}
+
+	conn, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte("Proxy Error: " + err.Error()))
+		return
+	}
+	defer conn.Close()
+
+	// The upgraded connection is not limited by the timeouts of the request
+	conn.SetDeadline(time.Time{})
+
+	addVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+	resp.Body = nil
+	err = resp.Write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		logError("Proxy: upgrade of %s failed - %s\n", req.URL.Path, err.Error())
+		return
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(backend, buffered)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(conn, backend)
+		done <- err
+	}()
+	<-done
+}
@@ -1,3 +1,7 @@
 module github.com/sirion/goproxy
 
-go 1.15
+go 1.24
+
+require software.sslmate.com/src/go-pkcs12 v0.5.0
+
+require golang.org/x/crypto v0.11.0 // indirect